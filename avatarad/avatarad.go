@@ -9,35 +9,95 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/HugoSmits86/nativewebp"
 	"github.com/caarlos0/env/v10"
-	"github.com/nfnt/resize"
 )
 
 type config struct {
-	CAcrtFile       string `env:"LDAP_SSL_CACERT_FILE"`
-	LdapServerFQDN  string `env:"LDAP_SERVER_FQDN,required"`
-	LdapPort        int    `env:"LDAP_PORT"                   envDefault:"636"`
-	LdapSSL         bool   `env:"LDAP_SSL"                    envDefault:"true"`
-	LdapTLS         bool   `env:"LDAP_TLS"                    envDefault:"false"`
-	LdapVerifyCert  bool   `env:"LDAP_VERIFY_CERT"            envDefault:"true"`
-	LdapBindUser    string `env:"LDAP_BIND_USER,required"`
-	LdapBindPasswd  string `env:"LDAP_BIND_PASSWORD,required"`
-	LdapUserBase    string `env:"LDAP_USER_BASE,required"`
-	LdapUserFilter  string `env:"LDAP_USER_FILTER"            envDefault:"(objectclass=inetOrgPerson)"`
-	LdapAvatarAttr  string `env:"LDAP_AVATAR_ATTRIBUTE"       envDefault:"jpegPhoto"`
-	LdapEmailAttr   string `env:"LDAP_EMAIL_ATTRIBUTE"        envDefault:"mail"`
-	GravatarEnabled bool   `env:"GRAVATAR_ENABLED"            envDefault:"false"`
-	GravatarURL     string `env:"GRAVATAR_URL"                envDefault:"https://secure.gravatar.com/avatar"`
+	CAcrtFile       string   `env:"LDAP_SSL_CACERT_FILE"`
+	LdapServerFQDN  string   `env:"LDAP_SERVER_FQDN,required"`
+	LdapPort        int      `env:"LDAP_PORT"                   envDefault:"636"`
+	LdapSSL         bool     `env:"LDAP_SSL"                    envDefault:"true"`
+	LdapTLS         bool     `env:"LDAP_TLS"                    envDefault:"false"`
+	LdapVerifyCert  bool     `env:"LDAP_VERIFY_CERT"            envDefault:"true"`
+	LdapBindUser    string   `env:"LDAP_BIND_USER,required"`
+	LdapBindPasswd  string   `env:"LDAP_BIND_PASSWORD,required"`
+	LdapUserBase    string   `env:"LDAP_USER_BASE,required"`
+	LdapUserFilter  string   `env:"LDAP_USER_FILTER"            envDefault:"(objectclass=inetOrgPerson)"`
+	LdapAvatarAttr  string   `env:"LDAP_AVATAR_ATTRIBUTE"       envDefault:"jpegPhoto"`
+	LdapEmailAttr   string   `env:"LDAP_EMAIL_ATTRIBUTE"        envDefault:"mail"`
+	LdapOpenIDAttr  string   `env:"LDAP_OPENID_ATTRIBUTE"`
+	LdapUIDAttr     string   `env:"LDAP_UID_ATTRIBUTE"          envDefault:"uid"`
+	LdapURLAttr     string   `env:"LDAP_PHOTO_URL_ATTRIBUTE"`
+	LdapRefresh     int      `env:"LDAP_REFRESH_INTERVAL"       envDefault:"300"`
+	PhotoURLHosts   []string `env:"PHOTO_URL_HOSTS"`
+	GravatarEnabled bool     `env:"GRAVATAR_ENABLED"            envDefault:"false"`
+	GravatarURL     string   `env:"GRAVATAR_URL"                envDefault:"https://secure.gravatar.com/avatar"`
+	FitMode         string   `env:"FIT_MODE"                    envDefault:"crop"`
+	BackgroundColor string   `env:"BACKGROUND_COLOR"            envDefault:"ffffff"`
+	ResampleFilter  string   `env:"RESAMPLE_FILTER"             envDefault:"lanczos3"`
+	JpegQuality     int      `env:"JPEG_QUALITY"                envDefault:"90"`
+	PngCompression  string   `env:"PNG_COMPRESSION"             envDefault:"default"`
+	SharpenAmount   float64  `env:"SHARPEN_AMOUNT"              envDefault:"0"`
+	SharpenRadius   float64  `env:"SHARPEN_RADIUS"              envDefault:"0.5"`
+	SizeBands       []string `env:"SIZE_BANDS"                  envSeparator:";"`
+	MinSize         uint64   `env:"MIN_SIZE"                    envDefault:"1"`
+	MaxSize         uint64   `env:"MAX_SIZE"                    envDefault:"2048"`
+	UpscalePolicy   string   `env:"UPSCALE_POLICY"              envDefault:"allow"`
+	UpscaleFactor   float64  `env:"UPSCALE_FACTOR"              envDefault:"2"`
+	MaxImageBytes   int64    `env:"MAX_IMAGE_BYTES"             envDefault:"10485760"`
+	MaxImagePixels  int64    `env:"MAX_IMAGE_PIXELS"            envDefault:"40000000"`
+	LadderEnabled   bool     `env:"PRERENDER_ENABLED"           envDefault:"true"`
+	LadderSizes     []uint64 `env:"PRERENDER_SIZES"             envDefault:"24,32,48,80,128,256"`
+	LadderFormats   []string `env:"PRERENDER_FORMATS"           envDefault:"source,webp"`
+	LadderWorkers   int      `env:"PRERENDER_WORKERS"           envDefault:"0"`
+	SrcsetDensities []string `env:"SRCSET_DENSITIES"            envDefault:"1,2,3"`
+	PublicURL       string   `env:"PUBLIC_URL"`
+	Shape           string   `env:"SHAPE"                       envDefault:"square"`
+	CornerRadius    float64  `env:"CORNER_RADIUS"               envDefault:"0.2"`
+	DefaultAvatar   string   `env:"DEFAULT_AVATAR"              envDefault:"image"`
+	MasterMaxSize   uint64   `env:"MASTER_MAX_SIZE"             envDefault:"1024"`
+	MasterFormat    string   `env:"MASTER_FORMAT"               envDefault:"jpeg"`
+	DialTimeout     int      `env:"UPSTREAM_DIAL_TIMEOUT"       envDefault:"3"`
+	UpstreamTimeout int      `env:"UPSTREAM_TIMEOUT"            envDefault:"10"`
+	UpstreamCAFile  string   `env:"UPSTREAM_CA_FILE"`
+	UserAgent       string   `env:"UPSTREAM_USER_AGENT"`
+	BreakerFailures int      `env:"BREAKER_FAILURES"            envDefault:"5"`
+	BreakerCooldown int      `env:"BREAKER_COOLDOWN"            envDefault:"30"`
+	NegativeTTL     int      `env:"NEGATIVE_TTL"                envDefault:"300"`
+	UpstreamMaxTTL  int      `env:"UPSTREAM_MAX_TTL"            envDefault:"86400"`
+	Libravatar      bool     `env:"LIBRAVATAR_ENABLED"          envDefault:"false"`
+	LibravatarHints []string `env:"LIBRAVATAR_DOMAINS"`
+	SourceTTLs      []string `env:"SOURCE_TTLS"`
+	SourceTimeouts  []string `env:"SOURCE_TIMEOUTS"`
+	PhotoDir        string   `env:"PHOTO_DIRECTORY"`
+	DBDriver        string   `env:"DB_DRIVER"                   envDefault:"postgres"`
+	DBSource        string   `env:"DB_DSN"`
+	DBQuery         string   `env:"DB_QUERY"`
+	DBPoll          int      `env:"DB_POLL_INTERVAL"            envDefault:"60"`
+	S3Endpoint      string   `env:"S3_ENDPOINT"`
+	S3Region        string   `env:"S3_REGION"                   envDefault:"us-east-1"`
+	S3Bucket        string   `env:"S3_BUCKET"`
+	S3Prefix        string   `env:"S3_PREFIX"`
+	S3AccessKey     string   `env:"S3_ACCESS_KEY_ID"`
+	S3SecretKey     string   `env:"S3_SECRET_ACCESS_KEY"`
+	S3Cache         bool     `env:"S3_CACHE_ENABLED"            envDefault:"false"`
+
+	// the sources avatars are looked up in, in order
+	Sources []string `env:"SOURCES" envDefault:"ldap,url,directory,database,s3,libravatar,gravatar"`
 }
 
 type service struct {
@@ -48,15 +108,40 @@ type service struct {
 type avatar struct {
 	Image      []byte
 	LastUpdate time.Time
+	Crop       image.Rectangle
+	Format     string
+	Checksum   string
+	Source     string
+	// cache validators and lifetime sent by the upstream
+	ETag         string
+	LastModified string
+	MaxAge       time.Duration
 }
 
 const (
+	acceptHeader        = "Accept"
 	contentType         = "Content-Type"
 	defaultTimeout      = 3
 	defaultJpegQuality  = 90
+	formatGif           = "gif"
+	formatJpeg          = "jpeg"
+	formatPng           = "png"
+	formatSvg           = "svg+xml"
+	formatWebp          = "webp"
 	frameOptionsHeader  = "X-Frame-Options"
 	frameOptionsValue   = "DENY"
 	serverPort          = ":8080"
+	sourceDatabase      = "database"
+	sourceDefault       = "default"
+	sourceDirectory     = "directory"
+	sourceGenerated     = "generated"
+	sourceGravatar      = "gravatar"
+	sourceHeader        = "X-Avatar-Source"
+	sourceLDAP          = "ldap"
+	sourceLibravatar    = "libravatar"
+	sourceS3            = "s3"
+	sourceURL           = "url"
+	varyHeader          = "Vary"
 	xssProtectionHeader = "X-XSS-Protection"
 	xssProtectionValue  = "1; mode=block"
 )
@@ -65,6 +150,8 @@ var (
 	cfg config
 	//go:embed media/default.jpg
 	defaultAvatar []byte
+	defaultMaster avatar
+	defaultOnce   sync.Once
 	hs            map[string]avatar
 	lock          = sync.RWMutex{}
 	maxTime       time.Duration
@@ -72,6 +159,18 @@ var (
 	epoch         = time.Unix(0, 0).Format(time.RFC1123)
 )
 
+// extFormats maps URL extensions to output formats; an empty extension
+// leaves the choice to content negotiation.
+var extFormats = map[string]string{
+	"":     "",
+	"gif":  formatGif,
+	"jpeg": formatJpeg,
+	"jpg":  formatJpeg,
+	"png":  formatPng,
+	"svg":  formatSvg,
+	"webp": formatWebp,
+}
+
 var noCacheHeaders = map[string]string{
 	"Expires":         epoch,
 	"Cache-Control":   "no-cache, no-store, no-transform, must-revalidate, private, max-age=0",
@@ -89,6 +188,70 @@ func panicIf(err error, what ...string) {
 	}
 }
 
+func checkConfig() error {
+	if !fitModes[cfg.FitMode] {
+		return errors.New("unsupported fit mode " + cfg.FitMode)
+	}
+
+	if _, err := parseColor(cfg.BackgroundColor); err != nil {
+		return fmt.Errorf("BACKGROUND_COLOR: %w", err)
+	}
+
+	if err := checkSizeConfig(); err != nil {
+		return err
+	}
+
+	if err := checkLimitsConfig(); err != nil {
+		return err
+	}
+
+	if err := checkPrerenderConfig(); err != nil {
+		return err
+	}
+
+	if err := checkDPRConfig(); err != nil {
+		return err
+	}
+
+	if err := checkShapeConfig(); err != nil {
+		return err
+	}
+
+	if err := checkMasterConfig(); err != nil {
+		return err
+	}
+
+	if err := checkUpstreamConfig(); err != nil {
+		return err
+	}
+
+	if err := checkSourcesConfig(); err != nil {
+		return err
+	}
+
+	if err := checkDatabaseConfig(); err != nil {
+		return err
+	}
+
+	if err := checkPhotoURLConfig(); err != nil {
+		return err
+	}
+
+	if err := checkS3Config(); err != nil {
+		return err
+	}
+
+	if cfg.NegativeTTL < 1 || cfg.UpstreamMaxTTL < 1 {
+		return errors.New("NEGATIVE_TTL and UPSTREAM_MAX_TTL must be positive")
+	}
+
+	if !defaultAvatars[cfg.DefaultAvatar] {
+		return errors.New("unsupported default avatar " + cfg.DefaultAvatar)
+	}
+
+	return parseRenderConfig()
+}
+
 func writeNoCacheHeaders(w http.ResponseWriter) {
 	for k, v := range noCacheHeaders {
 		w.Header().Set(k, v)
@@ -105,7 +268,9 @@ func newService() *service {
 
 	mux.HandleFunc("/version", versionHandler)
 	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
 	mux.HandleFunc("/avatar/", avatarHandler)
+	mux.HandleFunc("/srcset/", srcsetHandler)
 
 	return &service{
 		httpServer: &http.Server{
@@ -135,9 +300,34 @@ func main() {
 
 	err := env.Parse(&cfg)
 	panicIf(err, "while reading configuration")
+	panicIf(checkConfig(), "while checking configuration")
+
+	_, err = gravatarUpstream()
+	panicIf(err, "while setting up Gravatar client")
+
+	if len(cfg.S3Endpoint) > 0 {
+		storage, err = newS3Client()
+		panicIf(err, "while setting up S3 client")
+	}
 
 	hs = make(map[string]avatar)
+	startRenderers(cfg.LadderWorkers)
+
+	if len(cfg.PhotoDir) > 0 {
+		watcher, err := watchPhotoDir()
+		panicIf(err, "while watching "+cfg.PhotoDir)
+		defer watcher.Close()
+	}
+
 	fillHash()
+	refreshLDAPEvery()
+
+	if len(cfg.DBSource) > 0 {
+		db, err := openDatabase()
+		panicIf(err, "while reading photos from the database")
+		defer db.Close()
+		pollDatabaseEvery(db)
+	}
 
 	svc := newService()
 
@@ -197,80 +387,280 @@ func hsDelete(h string) {
 	defer lock.Unlock()
 
 	delete(hs, h)
+	delete(ladders, h)
 }
 
+// newAvatar normalizes image data into a cache entry, picking the crop box
+// once so every resized variant is framed the same way. Format is the format
+// of the source image, which is served unless the client asks otherwise.
+func newAvatar(data []byte) (avatar, error) {
+	av := avatar{
+		Image:      data,
+		LastUpdate: time.Now(),
+	}
+
+	master, img, format, err := normalize(data)
+	if err != nil {
+		return av, err
+	}
+
+	av.Image = master
+	av.Format = format
+	av.Checksum = checksum(master)
+	av.Crop = smartCrop(img)
+
+	return av, nil
+}
+
+// newDefaultAvatar returns a negative cache entry holding the default
+// avatar, which is normalized once and shared by all entries.
+func newDefaultAvatar() avatar {
+	defaultOnce.Do(func() {
+		defaultMaster, _ = newAvatar(defaultAvatar)
+	})
+
+	av := defaultMaster
+	av.LastUpdate = time.Now()
+	av.Source = sourceDefault
+
+	return av
+}
+
+// negative reports whether the entry records that no photo was found.
+func (av avatar) negative() bool {
+	return av.Source == sourceDefault
+}
+
+// expired reports whether the entry must be looked up again: negative
+// entries live for NEGATIVE_TTL, photos for the lifetime stated by their
+// upstream or the SOURCE_TTLS of their source. The lifetime of database
+// photos runs from the last poll, which keeps them current.
+func (av avatar) expired() bool {
+	var ttl time.Duration
+
+	switch {
+	case av.negative():
+		ttl = time.Duration(cfg.NegativeTTL) * time.Second
+	case av.MaxAge > 0:
+		ttl = av.MaxAge
+	default:
+		ttl = sourceTTL(av.Source)
+	}
+
+	if av.Source == sourceDatabase {
+		return time.Since(dbCheckedAt(av.LastUpdate)) > ttl
+	}
+
+	return time.Since(av.LastUpdate) > ttl
+}
+
+// pruneHash drops the expired entries. The cache is written from the photo
+// directory watcher and the database poller too, so it is held locked while
+// it is walked.
 func pruneHash() {
-	for h := range hs {
-		av := hsGet(h)
-		if len(av.Image) > 0 && time.Since(av.LastUpdate) > maxTime {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for h, av := range hs {
+		if len(av.Image) > 0 && av.expired() {
 			fmt.Fprintln(os.Stderr, h+" × cache")
-			hsDelete(h)
+			delete(hs, h)
+			delete(ladders, h)
 		}
 	}
 }
 
-func getAvatar(h string) avatar {
-	var (
-		body []byte
-		av   avatar
-	)
+// getAvatar returns the avatar of h from the cache or, if it is not cached,
+// from the first source of SOURCES that has it; hint is the email domain
+// given by the client, if any.
+func getAvatar(h, hint string) avatar {
+	av := hsGet(h)
+	if len(av.Image) > 0 && !av.expired() {
+		fmt.Fprintln(os.Stderr, h+" → cached")
 
-	av = hsGet(h)
-	if len(av.Image) == 0 || time.Since(av.LastUpdate) > maxTime {
-		pruneHash()
-		fillHash()
-		av = hsGet(h)
-		if len(av.Image) > 0 {
-			fmt.Fprintln(os.Stderr, h+" → cached")
+		return av
+	}
 
-			return av
-		}
-		fmt.Fprintln(os.Stderr, h+" × LDAP")
-		if cfg.GravatarEnabled {
-			res, err := http.Get(cfg.GravatarURL + "/" + h + "?s=490&d=" + strconv.Itoa(http.StatusNotFound))
-			if err == nil && res.StatusCode == http.StatusOK {
-				body, err = io.ReadAll(res.Body)
-				cerr := res.Body.Close()
-				if err == nil && cerr == nil {
-					hsWrite(h, avatar{
-						Image:      body,
-						LastUpdate: time.Now(),
-					})
-					fmt.Fprintln(os.Stderr, h+" → Gravatar")
-
-					return hsGet(h)
-				}
-			}
-			fmt.Fprintln(os.Stderr, h+" × Gravatar")
-		}
-		fmt.Fprintln(os.Stderr, h+" → default")
+	// another replica may have looked it up already
+	if shared, ok := sharedMaster(h); ok {
+		fmt.Fprintln(os.Stderr, h+" → S3 cache")
+		hsWrite(h, shared)
+		queueRender(shared, h)
+
+		return shared
+	}
 
-		hsWrite(h, avatar{
-			Image:      defaultAvatar,
-			LastUpdate: time.Now(),
-		})
+	// the expired entry is kept for revalidation, pruning drops it from
+	// the cache
+	pruneHash()
+
+	if found, ok := lookupChain(lookupRequest{hash: h, domain: hint, cached: av}); ok {
+		hsWrite(h, found)
+		shareMaster(h, found)
+
+		// LDAP and database photos were queued when they were read
+		if l := ladderGet(h); !found.negative() && (l == nil || !l.source.Equal(found.LastUpdate)) {
+			queueRender(found, h)
+		}
 
-		return hsGet(h)
+		return found
 	}
-	fmt.Fprintln(os.Stderr, h+" → cached")
+	fmt.Fprintln(os.Stderr, h+" → default")
+
+	av = newDefaultAvatar()
+	hsWrite(h, av)
 
 	return av
 }
 
-func encodeAvatar(img image.Image, format string) ([]byte, error) {
+func encodeAvatar(img image.Image, format string, opts renderOptions) ([]byte, error) {
 	var err error
 
 	buf := new(bytes.Buffer)
 	switch format {
-	case "jpeg":
-		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: defaultJpegQuality})
-	case "png":
-		err = png.Encode(buf, img)
+	case formatJpeg:
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: opts.jpegQuality})
+	case formatPng:
+		enc := png.Encoder{CompressionLevel: opts.pngLevel}
+		err = enc.Encode(buf, img)
+	case formatGif:
+		err = gif.Encode(buf, img, nil)
+	case formatWebp:
+		err = nativewebp.Encode(buf, img, nil)
+	default:
+		err = errors.New("unsupported image format " + format)
 	}
 
 	return buf.Bytes(), err
 }
 
+// acceptsMime reports whether the Accept header explicitly lists mime with
+// a non-zero quality. Wildcards are ignored on purpose: every browser sends
+// */* and that must not switch the output away from the source format.
+func acceptsMime(accept, mime string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mime) {
+			continue
+		}
+
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "q") {
+				if q, err := strconv.ParseFloat(v, 64); err == nil && q <= 0 {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// outputFormat picks the encoder for the response: an explicit format taken
+// from the URL extension wins, then the Accept header, then the format of the
+// source image.
+func outputFormat(r *http.Request, format, srcFormat string) string {
+	if len(format) > 0 {
+		return format
+	}
+
+	if acceptsMime(r.Header.Get(acceptHeader), "image/"+formatWebp) {
+		return formatWebp
+	}
+
+	return srcFormat
+}
+
+// querySize returns the size requested with the s or size query parameter
+// or the default size.
+func querySize(q url.Values) uint64 {
+	qSize := ""
+	if s, ok := q["s"]; ok {
+		qSize = s[0]
+	} else if s, ok := q["size"]; ok {
+		qSize = s[0]
+	}
+
+	if s, err := strconv.ParseUint(qSize, 10, 64); err == nil {
+		return s
+	}
+
+	return defaultSize
+}
+
+// avatarRequest holds the options of an avatar request.
+type avatarRequest struct {
+	hash    string
+	format  string // taken from the URL extension, empty to negotiate
+	cssSize uint64
+	size    uint64 // in device pixels
+	mode    string
+	bgColor string
+	bg      color.Color
+	shape   string
+	static  bool
+}
+
+// defaults reports whether the request asks for the default framing.
+func (req avatarRequest) defaults() bool {
+	return req.mode == cfg.FitMode && req.bgColor == cfg.BackgroundColor && req.shape == cfg.Shape
+}
+
+// queryOption returns the query parameter name or def if it is not set.
+func queryOption(q url.Values, name, def string) string {
+	if v := q.Get(name); len(v) > 0 {
+		return v
+	}
+
+	return def
+}
+
+// parseAvatarRequest reads the avatar options from the URL and the client
+// hints of r.
+func parseAvatarRequest(r *http.Request) (avatarRequest, error) {
+	q := r.URL.Query()
+
+	dpr, err := requestDPR(r)
+	if err != nil {
+		return avatarRequest{}, err
+	}
+
+	req := avatarRequest{
+		cssSize: clampSize(querySize(q)),
+		mode:    queryOption(q, "fit", cfg.FitMode),
+		bgColor: queryOption(q, "bg", cfg.BackgroundColor),
+		shape:   queryOption(q, "shape", cfg.Shape),
+	}
+	req.size = clampSize(scaleSize(req.cssSize, dpr))
+	req.static, _ = strconv.ParseBool(q.Get("static"))
+
+	hash, ext, _ := strings.Cut(strings.Split(r.URL.Path, "/")[2], ".")
+	req.hash = strings.ToLower(hash)
+
+	format, ok := extFormats[strings.ToLower(ext)]
+	if !ok {
+		return avatarRequest{}, errors.New("unsupported image format")
+	}
+	req.format = format
+
+	if !fitModes[req.mode] {
+		return avatarRequest{}, errors.New("unsupported fit mode")
+	}
+
+	if req.bg, err = parseColor(req.bgColor); err != nil {
+		return avatarRequest{}, err
+	}
+
+	if !shapes[req.shape] {
+		return avatarRequest{}, errors.New("unsupported shape")
+	}
+
+	return req, nil
+}
+
 func avatarHandler(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -282,41 +672,182 @@ func avatarHandler(w http.ResponseWriter, r *http.Request) {
 	_, err := io.ReadAll(r.Body)
 	panicIf(err, "while reading request body")
 
-	var size uint64
+	q := r.URL.Query()
+
+	// client hints are requested on every response, so browsers send them
+	// from the next request on
+	writeClientHintHeaders(w)
+
+	req, err := parseAvatarRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	avatar := getAvatar(req.hash, hintDomain(q.Get("domain")))
 
+	if forceDefault(q) && !avatar.negative() {
+		avatar = newDefaultAvatar()
+	}
+
+	if avatar.negative() && serveDefault(w, r, req) {
+		return
+	}
+
+	if len(avatar.Source) > 0 {
+		w.Header().Set(sourceHeader, avatar.Source)
+	}
+
+	// photos are raster only
+	if req.format == formatSvg {
+		req.format = ""
+	}
+
+	if servePrerendered(w, r, req, avatar) {
+		return
+	}
+
+	serveResized(w, r, req, avatar)
+}
+
+// serveDefault answers a request for a missing avatar as the d parameter
+// asks. It reports false when the default image is to be served instead.
+func serveDefault(w http.ResponseWriter, r *http.Request, req avatarRequest) bool {
 	q := r.URL.Query()
-	size = 80
-	qSize := ""
-	if s, ok := q["s"]; ok {
-		qSize = s[0]
-	} else if s, ok := q["size"]; ok {
-		qSize = s[0]
+
+	switch generator(q) {
+	case generateIdenticon:
+		w.Header().Set(sourceHeader, sourceGenerated)
+		serveIdenticon(w, r, req)
+	case defaultBlank:
+		w.Header().Set(sourceHeader, sourceGenerated)
+		serveBlank(w, r, req)
+	case defaultNotFound:
+		w.Header().Set(sourceHeader, sourceDefault)
+		http.Error(w, "avatar not found", http.StatusNotFound)
+	case defaultRedirect:
+		w.Header().Set(sourceHeader, sourceDefault)
+		http.Redirect(w, r, redirectURL(defaultParam(q)), http.StatusFound)
+	default:
+		return false
 	}
-	if s, err := strconv.ParseUint(qSize, 10, 64); err == nil {
-		size = s
+
+	return true
+}
+
+// servePrerendered writes a pre-rendered variant of av if there is one for
+// the request.
+func servePrerendered(w http.ResponseWriter, r *http.Request, req avatarRequest, av avatar) bool {
+	if !req.defaults() {
+		return false
 	}
 
-	var (
-		resizedImg    image.Image
-		resizedAvatar []byte
-		avatar        avatar
-	)
+	// the default framing is served from the pre-rendered ladder, unless
+	// it is not ready yet or was rendered from an older image; then it may
+	// have been pre-rendered by another replica
+	if l := ladderGet(req.hash); l != nil && l.source.Equal(av.LastUpdate) {
+		size := limitUpscale(req.size, l.bounds, req.mode, av.Crop)
+		imgFormat := outputFormat(r, req.format, shapeFormat(l.format, req.shape))
+		data, dims, err := l.render(size, imgFormat)
+		if err != nil {
+			return false
+		}
+		writeAvatar(w, data, imgFormat, dims)
 
-	hash := strings.Split(strings.Split(r.URL.Path, "/")[2], ".")[0]
-	avatar = getAvatar(hash)
+		return true
+	}
 
-	buf := bytes.NewBuffer(avatar.Image)
-	img, imgFormat, err := image.Decode(buf)
+	if len(av.Format) == 0 {
+		return false
+	}
+
+	imgFormat := outputFormat(r, req.format, shapeFormat(av.Format, req.shape))
+	data, dims, ok := sharedVariant(av, req.size, imgFormat)
+	if ok {
+		writeAvatar(w, data, imgFormat, dims)
+	}
+
+	return ok
+}
+
+// serveResized decodes av and writes it resized for the request.
+func serveResized(w http.ResponseWriter, r *http.Request, req avatarRequest, av avatar) {
+	img, imgFormat, err := decodeImage(av.Image)
+	if err != nil {
+		// cached entries are checked at ingest, so this only happens when
+		// the limits were lowered in between
+		hsQuarantine(req.hash, err)
+		av = newDefaultAvatar()
+		hsWrite(req.hash, av)
+		w.Header().Set(sourceHeader, av.Source)
+
+		img, imgFormat, err = decodeImage(av.Image)
+	}
 	panicIf(err, "while decoding avatar")
+	if len(av.Format) > 0 {
+		imgFormat = av.Format
+	}
+
+	size := limitUpscale(req.size, img.Bounds(), req.mode, av.Crop)
+
+	opts := renderOptionsFor(size)
+	resizeFn := func(img image.Image, format string) image.Image {
+		img = fitImage(img, uint(size), req.mode, req.bg, av.Crop, opts.filter)
+
+		return finishImage(img, opts, req.shape, req.bg, format)
+	}
 
-	resizedImg = resize.Resize(uint(size), 0, img, resize.Lanczos3)
+	// animations are kept unless the client asks for a static image
+	// or for an explicit format other than GIF
+	if imgFormat == formatGif && !req.static && (len(req.format) == 0 || req.format == formatGif) {
+		if anim := decodeAnimation(av.Image); anim != nil {
+			data, dims := renderAnimation(anim, resizeFn)
+			writeAvatar(w, data, formatGif, dims)
 
-	resizedAvatar, err = encodeAvatar(resizedImg, imgFormat)
+			return
+		}
+	}
+
+	imgFormat = outputFormat(r, req.format, shapeFormat(imgFormat, req.shape))
+	data, dims := renderStill(img, imgFormat, opts, resizeFn)
+	writeAvatar(w, data, imgFormat, dims)
+}
+
+// renderAnimation resizes every frame of anim and encodes it as GIF.
+func renderAnimation(anim *gif.GIF, resize func(image.Image, string) image.Image) ([]byte, image.Point) {
+	anim = resizeAnimation(anim, func(img image.Image) image.Image {
+		return resize(img, formatGif)
+	})
+
+	data, err := encodeAnimation(anim)
+	panicIf(err, "while encoding animation")
+
+	return data, image.Pt(anim.Config.Width, anim.Config.Height)
+}
+
+// renderStill resizes img and encodes it in format.
+func renderStill(
+	img image.Image, format string, opts renderOptions, resize func(image.Image, string) image.Image,
+) ([]byte, image.Point) {
+	// the source bytes are never served as is, even at their original
+	// size: re-encoding strips EXIF, XMP and IPTC metadata
+	img = resize(img, format)
+
+	data, err := encodeAvatar(img, format, opts)
 	panicIf(err, "while encoding image")
 
-	w.Header().Set(contentType, "image/"+imgFormat)
-	w.Header().Set("Content-Length", strconv.Itoa(len(resizedAvatar)))
-	if _, err := w.Write(resizedAvatar); err != nil {
+	return data, img.Bounds().Size()
+}
+
+func writeAvatar(w http.ResponseWriter, data []byte, format string, dims image.Point) {
+	w.Header().Set(varyHeader, acceptHeader)
+	w.Header().Add(varyHeader, secDPRHeader+", "+dprHeader)
+	w.Header().Set(contentType, "image/"+format)
+	w.Header().Set(widthHeader, strconv.Itoa(dims.X))
+	w.Header().Set(heightHeader, strconv.Itoa(dims.Y))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if _, err := w.Write(data); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 	}
 }
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -186,6 +194,7 @@ func TestHandleAvatarEveUpdate(t *testing.T) {
 	_ = env.Parse(&cfg)
 
 	hs = make(map[string]avatar)
+	ldapRead = time.Time{}
 
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("GET", "/avatar/38ff3520bdcc16a3bbe247f78a8e1610", nil)
@@ -462,3 +471,318 @@ func TestMainUseTLS(t *testing.T) {
 
 	main()
 }
+
+// parseTestConfig reads cfg from the environment, extra settings may be put
+// with t.Setenv beforehand.
+func parseTestConfig(t *testing.T) {
+	t.Helper()
+
+	t.Setenv("LDAP_SERVER_FQDN", conf.LdapServerFQDN)
+	t.Setenv("LDAP_BIND_USER", conf.LdapBindUser)
+	t.Setenv("LDAP_BIND_PASSWORD", conf.LdapBindPasswd)
+	t.Setenv("LDAP_USER_BASE", conf.LdapUserBase)
+
+	cfg = config{}
+	if err := env.Parse(&cfg); err != nil {
+		t.Fatalf("%v while reading configuration", err)
+	}
+
+	if err := checkConfig(); err != nil {
+		t.Fatalf("%v while checking configuration", err)
+	}
+}
+
+// testJpeg returns a w×h JPEG with a colour gradient, so tests do not
+// depend on the LFS-tracked default avatar.
+func testJpeg(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: 128, A: 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatalf("%v while encoding test image", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestAcceptsMime(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"image/*", false},
+		{"image/webp", true},
+		{"image/avif,image/webp,image/apng,*/*;q=0.8", true},
+		{"image/png, IMAGE/WEBP;q=0.5", true},
+		{"image/webp;q=0", false},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsMime(tt.accept, "image/webp"); got != tt.want {
+			t.Errorf("acceptsMime(%q): want %v, got %v", tt.accept, tt.want, got)
+		}
+	}
+}
+
+func TestHandleAvatarWebp(t *testing.T) {
+	const m string = "11111111111111111111111111111111"
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testJpeg(t, 120, 160), LastUpdate: time.Now()}}
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/avatar/"+m+".webp", nil),
+		httptest.NewRequest("GET", "/avatar/"+m+"?s=32", nil),
+	} {
+		r.Header.Set("Accept", "image/webp,*/*")
+
+		w := httptest.NewRecorder()
+
+		avatarHandler(w, r)
+
+		if got, want := w.Header().Get("Content-Type"), "image/webp"; got != want {
+			t.Errorf("Want content type '%s', got '%s'", want, got)
+		}
+
+		if got, want := w.Header().Get("Vary"), "Accept"; got != want {
+			t.Errorf("Want Vary '%s', got '%s'", want, got)
+		}
+
+		if b := w.Body.Bytes(); len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+			t.Errorf("Response body is not a WebP image")
+		}
+	}
+}
+
+func TestHandleAvatarNoWebp(t *testing.T) {
+	const m string = "11111111111111111111111111111111"
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testJpeg(t, 120, 160), LastUpdate: time.Now()}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/avatar/"+m, nil)
+	r.Header.Set("Accept", "image/png,*/*;q=0.8")
+
+	avatarHandler(w, r)
+
+	_, imgType, err := image.Decode(w.Body)
+	if err != nil {
+		t.Errorf("%v while decoding response body", err)
+	}
+
+	if got, want := imgType, strJpeg; got != want {
+		t.Errorf("Want image type '%s', got '%s'", want, got)
+	}
+}
+
+func TestHandleAvatarExt(t *testing.T) {
+	const m string = "11111111111111111111111111111111"
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testJpeg(t, 120, 160), LastUpdate: time.Now()}}
+
+	tests := map[string]string{
+		".jpg":  "jpeg",
+		".JPEG": "jpeg",
+		".png":  "png",
+		".gif":  "gif",
+	}
+
+	for ext, want := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/avatar/"+m+ext, nil)
+		r.Header.Set("Accept", "image/webp")
+
+		avatarHandler(w, r)
+
+		if got, want := w.Header().Get("Content-Type"), "image/"+want; got != want {
+			t.Errorf("%s: want content type '%s', got '%s'", ext, want, got)
+		}
+
+		_, imgType, err := image.Decode(w.Body)
+		if err != nil {
+			t.Errorf("%s: %v while decoding response body", ext, err)
+		}
+
+		if imgType != want {
+			t.Errorf("%s: want image type '%s', got '%s'", ext, want, imgType)
+		}
+	}
+}
+
+func TestHandleAvatarBadExt(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/avatar/11111111111111111111111111111111.bmp", nil)
+
+	avatarHandler(w, r)
+
+	if got, want := w.Code, http.StatusBadRequest; want != got {
+		t.Errorf("Want response code %d, got %d", want, got)
+	}
+}
+
+func TestPruneHash(t *testing.T) {
+	const m, p string = "78787878787878787878787878787878", "89898989898989898989898989898989"
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{
+		m: {Image: []byte("old"), LastUpdate: time.Now().Add(-time.Hour), Source: sourceLDAP},
+		p: {Image: []byte("new"), LastUpdate: time.Now(), Source: sourceLDAP},
+	}
+
+	// background loaders write while requests prune
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				hsWrite(strconv.Itoa(i*100+j), avatar{Image: []byte("x"), LastUpdate: time.Now()})
+			}
+		}()
+	}
+
+	for range 20 {
+		pruneHash()
+	}
+	wg.Wait()
+
+	if _, ok := hs[m]; ok {
+		t.Error("Want expired entry pruned")
+	}
+
+	if _, ok := hs[p]; !ok {
+		t.Error("Want fresh entry kept")
+	}
+}
+
+func TestNegativeEntries(t *testing.T) {
+	t.Setenv("NEGATIVE_TTL", "60")
+	parseTestConfig(t)
+
+	old := time.Now().Add(-2 * time.Minute)
+
+	tests := []struct {
+		av       avatar
+		negative bool
+		expired  bool
+	}{
+		{avatar{Source: sourceDefault, LastUpdate: time.Now()}, true, false},
+		{avatar{Source: sourceDefault, LastUpdate: old}, true, true},
+		{avatar{Source: sourceLDAP, LastUpdate: old}, false, false},
+		{avatar{Source: sourceGravatar, LastUpdate: old}, false, false},
+		{avatar{Source: sourceLDAP, LastUpdate: time.Now().Add(-time.Hour)}, false, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.av.negative(); got != tt.negative {
+			t.Errorf("%s: want negative %t, got %t", tt.av.Source, tt.negative, got)
+		}
+
+		if got := tt.av.expired(); got != tt.expired {
+			t.Errorf("%s updated %v: want expired %t, got %t", tt.av.Source, tt.av.LastUpdate, tt.expired, got)
+		}
+	}
+
+	if av := newDefaultAvatar(); !av.negative() {
+		t.Error("Want default avatar entries to be negative")
+	}
+}
+
+func TestNegativeLDAPPhoto(t *testing.T) {
+	// eve has a photo in LDAP
+	const m string = "38ff3520bdcc16a3bbe247f78a8e1610"
+
+	t.Setenv("LDAP_SERVER_FQDN", conf.LdapServerFQDN)
+	t.Setenv("LDAP_BIND_USER", conf.LdapBindUser)
+	t.Setenv("LDAP_BIND_PASSWORD", conf.LdapBindPasswd)
+	t.Setenv("LDAP_USER_BASE", conf.LdapUserBase)
+	t.Setenv("LDAP_VERIFY_CERT", "false")
+	t.Setenv("SOURCES", "ldap")
+	parseTestConfig(t)
+
+	// LDAP is not reachable until the refresh below, a read would fail
+	port := cfg.LdapPort
+	cfg.LdapPort = 1
+
+	// the photo was added after LDAP was last read
+	hs = map[string]avatar{m: newDefaultAvatar()}
+	ldapRead = time.Now()
+
+	if got := getAvatar(m, ""); !got.negative() {
+		t.Errorf("Want the fresh negative entry served, got source '%s'", got.Source)
+	}
+
+	hs = map[string]avatar{}
+	if _, err := (ldapSource{}).lookup(context.Background(), lookupRequest{hash: m}); !errors.Is(err, errNotFound) {
+		t.Errorf("Want a miss without reading LDAP again, got %v", err)
+	}
+
+	cfg.LdapPort = port
+	hs = map[string]avatar{m: newDefaultAvatar()}
+
+	if err := refreshLDAP(context.Background(), true); err != nil {
+		t.Fatalf("%v while refreshing LDAP", err)
+	}
+
+	if got := getAvatar(m, ""); got.Source != sourceLDAP {
+		t.Errorf("Want the negative entry replaced by the refresh, got source '%s'", got.Source)
+	}
+
+	// an expired LDAP photo has LDAP read again at once
+	av := hsGet(m)
+	av.LastUpdate = av.LastUpdate.Add(-time.Hour)
+	hsWrite(m, av)
+
+	if got := getAvatar(m, ""); got.Source != sourceLDAP || got.expired() {
+		t.Errorf("Want the LDAP photo renewed, got source '%s'", got.Source)
+	}
+}
+
+func TestHandleAvatarNegative(t *testing.T) {
+	const m, p string = "12121212121212121212121212121212", "34343434343434343434343434343434"
+
+	parseTestConfig(t)
+
+	// a fresh negative entry is answered without asking the sources after
+	// LDAP, which has no photo for it
+	hs = map[string]avatar{
+		m: newDefaultAvatar(),
+		p: {Image: testJpeg(t, 60, 60), LastUpdate: time.Now(), Source: sourceLDAP},
+	}
+
+	if got := getAvatar(m, ""); !got.negative() {
+		t.Errorf("Want cached negative entry, got source '%s'", got.Source)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{m + "?d=identicon", sourceGenerated},
+		{p, sourceLDAP},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		avatarHandler(w, httptest.NewRequest("GET", "/avatar/"+tt.path, nil))
+
+		if got := w.Header().Get("X-Avatar-Source"); got != tt.want {
+			t.Errorf("%s: want source '%s', got '%s'", tt.path, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	// cropSamples is the number of samples taken along the longer side.
+	cropSamples = 64
+	// skinWeight makes skin-tone pixels outweigh plain edges.
+	skinWeight = 4
+	// edgeThreshold filters out noise and JPEG artifacts.
+	edgeThreshold = 24
+	// topBias favours windows above the centre: head-and-shoulders shots
+	// have faces in the upper part and cutting the head off looks worst.
+	topBias = 0.1
+)
+
+// isSkin is the RGB skin-tone rule by Kovač et al. for daylight photos.
+func isSkin(c color.Color) bool {
+	r32, g32, b32, _ := c.RGBA()
+	r, g, b := int(r32>>8), int(g32>>8), int(b32>>8)
+
+	return r > 95 && g > 40 && b > 20 &&
+		max(r, g, b)-min(r, g, b) > 15 &&
+		r-g > 15 && r > b
+}
+
+func luma(c color.Color) int {
+	r, g, b, _ := c.RGBA()
+
+	return int(299*r+587*g+114*b) / 1000 >> 8
+}
+
+// saliencyProfile samples img on a coarse grid and sums skin-tone and edge
+// scores across the shorter side, one value per sample along the longer one.
+func saliencyProfile(img image.Image, step int, portrait bool) []float64 {
+	b := img.Bounds()
+
+	long, short := b.Dx(), b.Dy()
+	if portrait {
+		long, short = short, long
+	}
+
+	at := func(l, s int) color.Color {
+		if portrait {
+			return img.At(b.Min.X+s, b.Min.Y+l)
+		}
+
+		return img.At(b.Min.X+l, b.Min.Y+s)
+	}
+
+	profile := make([]float64, 0, long/step+1)
+	for l := 0; l < long; l += step {
+		var score float64
+
+		for s := 0; s < short; s += step {
+			c := at(l, s)
+			if isSkin(c) {
+				score += skinWeight
+			}
+
+			if s+step < short {
+				if d := luma(c) - luma(at(l, s+step)); d > edgeThreshold || d < -edgeThreshold {
+					score++
+				}
+			}
+		}
+
+		profile = append(profile, score)
+	}
+
+	return profile
+}
+
+// smartCrop picks the square region of img most likely holding the face:
+// the window along the longer side with the highest saliency, preferring
+// upper windows for portraits when the scores are close.
+func smartCrop(img image.Image) image.Rectangle {
+	b := img.Bounds()
+	if b.Dx() == b.Dy() || b.Empty() {
+		return b
+	}
+
+	portrait := b.Dy() > b.Dx()
+	side := min(b.Dx(), b.Dy())
+	step := max(1, max(b.Dx(), b.Dy())/cropSamples)
+
+	profile := saliencyProfile(img, step, portrait)
+	window := max(1, side/step)
+	slots := len(profile) - window + 1
+
+	var total float64
+	for _, v := range profile {
+		total += v
+	}
+
+	scores := make([]float64, max(slots, 1))
+	for i := range scores {
+		for _, v := range profile[i:min(i+window, len(profile))] {
+			scores[i] += v
+		}
+
+		if portrait && slots > 1 {
+			scores[i] += total * topBias * float64(slots-1-i) / float64(slots-1)
+		}
+	}
+
+	// start from the centre so featureless images get a centered crop
+	best := (len(scores) - 1) / 2
+	for i, score := range scores {
+		if score > scores[best] {
+			best = i
+		}
+	}
+
+	offset := min(best*step, max(b.Dx(), b.Dy())-side)
+	if portrait {
+		return image.Rect(b.Min.X, b.Min.Y+offset, b.Max.X, b.Min.Y+offset+side)
+	}
+
+	return image.Rect(b.Min.X+offset, b.Min.Y, b.Min.X+offset+side, b.Max.Y)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+var (
+	testSkin       = color.RGBA{R: 224, G: 172, B: 140, A: 255}
+	testBackground = color.RGBA{R: 90, G: 110, B: 140, A: 255}
+)
+
+// testPortrait draws a skin-coloured "face" at r on a plain background.
+func testPortrait(bounds, face image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(bounds)
+	draw.Draw(img, bounds, image.NewUniform(testBackground), image.Point{}, draw.Src)
+	draw.Draw(img, face, image.NewUniform(testSkin), image.Point{}, draw.Src)
+
+	return img
+}
+
+func TestSmartCrop(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds image.Rectangle
+		face   image.Rectangle
+	}{
+		{"face on top", image.Rect(0, 0, 120, 160), image.Rect(40, 5, 80, 50)},
+		{"face at bottom", image.Rect(0, 0, 120, 200), image.Rect(40, 150, 80, 195)},
+		{"face on the left", image.Rect(0, 0, 300, 100), image.Rect(10, 20, 60, 80)},
+		{"offset bounds", image.Rect(10, 10, 130, 170), image.Rect(50, 15, 90, 60)},
+	}
+
+	for _, tt := range tests {
+		got := smartCrop(testPortrait(tt.bounds, tt.face))
+
+		if got.Dx() != got.Dy() || !got.In(tt.bounds) {
+			t.Errorf("%s: want square inside %v, got %v", tt.name, tt.bounds, got)
+		}
+
+		if !tt.face.In(got) {
+			t.Errorf("%s: want %v inside crop box %v", tt.name, tt.face, got)
+		}
+	}
+}
+
+func TestSmartCropFeatureless(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+
+	if got, want := smartCrop(img), image.Rect(100, 0, 200, 100); got != want {
+		t.Errorf("Want centered crop box %v, got %v", want, got)
+	}
+}
+
+func TestNewAvatarCrop(t *testing.T) {
+	parseTestConfig(t)
+
+	av, err := newAvatar(testJpeg(t, 120, 160))
+	if err != nil {
+		t.Fatalf("%v while ingesting avatar", err)
+	}
+
+	if got := av.Crop; got.Dx() != 120 || got.Dy() != 120 {
+		t.Errorf("Want 120x120 crop box, got %v", got)
+	}
+
+	if av, err := newAvatar([]byte("not an image")); err == nil || !av.Crop.Empty() {
+		t.Errorf("Want error and empty crop box for broken image, got %v, %v", err, av.Crop)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq" // PostgreSQL driver for DB_DRIVER=postgres
+)
+
+var (
+	// dbAvatars holds the photos read from the database by hash, so
+	// entries dropped from the cache are served without a query
+	dbAvatars = map[string]avatar{}
+	// dbUpdated holds the updated_at of the rows read by email; dbCursor
+	// is the latest of them, passed to DB_QUERY to read newer rows only
+	dbUpdated = map[string]time.Time{}
+	dbCursor  time.Time
+	// dbPolled is the time of the last successful poll
+	dbPolled time.Time
+	dbMu     sync.RWMutex
+)
+
+func checkDatabaseConfig() error {
+	if len(cfg.DBSource) == 0 {
+		return nil
+	}
+
+	if !slices.Contains(sql.Drivers(), cfg.DBDriver) {
+		return errors.New("unsupported database driver " + cfg.DBDriver)
+	}
+
+	if len(cfg.DBQuery) == 0 {
+		return errors.New("DB_QUERY must be set along with DB_DSN")
+	}
+
+	if cfg.DBPoll < 1 {
+		return errors.New("DB_POLL_INTERVAL must be positive")
+	}
+
+	return nil
+}
+
+// replaceable reports whether a cache entry may be replaced with a photo
+// from the database: photos from LDAP and the photo directory win.
+func replaceable(cached avatar) bool {
+	return len(cached.Image) == 0 || cached.expired() ||
+		(cached.Source != sourceLDAP && cached.Source != sourceDirectory)
+}
+
+// pollDatabase reads the rows of DB_QUERY updated since the last poll and
+// caches their photos under the hashes of their email.
+func pollDatabase(ctx context.Context, db *sql.DB) error {
+	dbMu.RLock()
+	cursor := dbCursor
+	dbMu.RUnlock()
+
+	start := time.Now()
+
+	rows, err := db.QueryContext(ctx, cfg.DBQuery, cursor)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			mail    string
+			data    []byte
+			updated time.Time
+		)
+
+		if err := rows.Scan(&mail, &data, &updated); err != nil {
+			return err
+		}
+
+		mail = normalizeEmail(mail)
+		if len(mail) == 0 {
+			continue
+		}
+
+		// the query may return rows of the last poll again, when it
+		// compares with >= so rows of the same instant are not lost
+		dbMu.RLock()
+		known, ok := dbUpdated[mail]
+		dbMu.RUnlock()
+		if ok && !updated.After(known) {
+			continue
+		}
+
+		hashes := emailHashes(mail)
+
+		dbMu.Lock()
+		dbUpdated[mail] = updated
+		if updated.After(dbCursor) {
+			dbCursor = updated
+		}
+		dbMu.Unlock()
+
+		// deleted rows are not seen by incremental polls, a photo is
+		// removed by clearing the image
+		if len(data) == 0 {
+			dropDatabasePhoto(hashes)
+
+			continue
+		}
+
+		av := ingestAvatar(data, sourceDatabase, hashes...)
+
+		dbMu.Lock()
+		for _, h := range hashes {
+			dbAvatars[h] = av
+		}
+		dbMu.Unlock()
+
+		var stale []string
+
+		for _, h := range hashes {
+			if replaceable(hsGet(h)) {
+				fmt.Fprintln(os.Stderr, h+" → database")
+				hsWrite(h, av)
+				stale = append(stale, h)
+			}
+		}
+		queueRender(av, stale...)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	dbMu.Lock()
+	dbPolled = start
+	dbMu.Unlock()
+
+	return nil
+}
+
+// dbCheckedAt returns when a photo ingested at updated was last known to be
+// current: a successful poll since would have replaced or dropped it.
+func dbCheckedAt(updated time.Time) time.Time {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	if dbPolled.After(updated) {
+		return dbPolled
+	}
+
+	return updated
+}
+
+func dropDatabasePhoto(hashes []string) {
+	dbMu.Lock()
+	for _, h := range hashes {
+		delete(dbAvatars, h)
+	}
+	dbMu.Unlock()
+
+	for _, h := range hashes {
+		if hsGet(h).Source == sourceDatabase {
+			fmt.Fprintln(os.Stderr, h+" × database")
+			hsDelete(h)
+		}
+	}
+}
+
+// openDatabase connects to DB_DSN and reads the photos once.
+func openDatabase() (*sql.DB, error) {
+	db, err := sql.Open(cfg.DBDriver, cfg.DBSource)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DBPoll)*time.Second)
+	defer cancel()
+
+	if err := pollDatabase(ctx, db); err != nil {
+		_ = db.Close()
+
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// pollDatabaseEvery reads updated photos every DB_POLL_INTERVAL seconds.
+func pollDatabaseEvery(db *sql.DB) {
+	interval := time.Duration(cfg.DBPoll) * time.Second
+
+	go func() {
+		for range time.Tick(interval) {
+			pollDatabaseOnce(db, interval)
+		}
+	}()
+}
+
+// pollDatabaseOnce polls within timeout. Errors and panics are logged, the
+// next poll tries again.
+func pollDatabaseOnce(db *sql.DB, timeout time.Duration) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "× database: %v\n", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := pollDatabase(ctx, db); err != nil {
+		fmt.Fprintln(os.Stderr, "× database: "+err.Error())
+	}
+}
+
+type databaseSource struct{}
+
+func (databaseSource) name() string {
+	return sourceDatabase
+}
+
+func (databaseSource) lookup(_ context.Context, req lookupRequest) (avatar, error) {
+	dbMu.RLock()
+	av, ok := dbAvatars[req.hash]
+	dbMu.RUnlock()
+
+	if !ok {
+		return avatar{}, errNotFound
+	}
+
+	return av, nil
+}
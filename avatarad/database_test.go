@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	// an in-memory database lives as long as its connection
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`CREATE TABLE portraits (email TEXT, photo BLOB, updated_at DATETIME)`); err != nil {
+		t.Skipf("%v while creating table, is cgo enabled?", err)
+	}
+
+	return db
+}
+
+func TestDatabaseConfig(t *testing.T) {
+	for _, kv := range [][2]string{
+		{"DB_DRIVER", "nodb"},
+		{"DB_QUERY", ""},
+		{"DB_POLL_INTERVAL", "0"},
+	} {
+		t.Run(kv[0], func(t *testing.T) {
+			parseTestConfig(t)
+
+			t.Setenv("DB_DSN", ":memory:")
+			t.Setenv("DB_DRIVER", "sqlite3")
+			t.Setenv("DB_QUERY", "SELECT email, photo, updated_at FROM portraits")
+			t.Setenv(kv[0], kv[1])
+			if err := env.Parse(&cfg); err != nil {
+				t.Fatalf("%v while reading configuration", err)
+			}
+
+			if err := checkConfig(); err == nil {
+				t.Errorf("%s=%s: want error", kv[0], kv[1])
+			}
+		})
+	}
+}
+
+func TestDatabaseSource(t *testing.T) {
+	t.Setenv("DB_DRIVER", "sqlite3")
+	t.Setenv("DB_DSN", ":memory:")
+	t.Setenv("DB_QUERY", "SELECT email, photo, updated_at FROM portraits WHERE updated_at >= ?")
+	parseTestConfig(t)
+
+	db := newTestDatabase(t)
+
+	jane, john := emailHashes("jane@example.com"), emailHashes("john@example.com")
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	hs = map[string]avatar{
+		john[0]: {Image: testJpeg(t, 30, 30), LastUpdate: time.Now(), Source: sourceLDAP},
+	}
+	dbAvatars, dbUpdated, dbCursor = map[string]avatar{}, map[string]time.Time{}, time.Time{}
+	t.Cleanup(func() { dbPolled = time.Time{} })
+
+	insert := func(mail string, photo []byte, updated time.Time) {
+		t.Helper()
+
+		if _, err := db.Exec(`INSERT INTO portraits VALUES (?, ?, ?)`, mail, photo, updated); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert("Jane@Example.com", testJpeg(t, 40, 40), base)
+	insert("john@example.com", testJpeg(t, 40, 40), base)
+
+	if err := pollDatabase(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	first := hsGet(jane[0])
+	if first.Source != sourceDatabase || hsGet(jane[1]).Checksum != first.Checksum {
+		t.Fatalf("Want photo from the database under both hashes, got source '%s'", first.Source)
+	}
+
+	if got := hsGet(john[0]).Source; got != sourceLDAP {
+		t.Errorf("Want LDAP photos kept, got source '%s'", got)
+	}
+
+	if !dbCursor.Equal(base) {
+		t.Errorf("Want cursor %v, got %v", base, dbCursor)
+	}
+
+	// only rows updated since are read again
+	if _, err := db.Exec(`UPDATE portraits SET photo = ?, updated_at = ? WHERE email = ?`,
+		testJpeg(t, 60, 60), base.Add(time.Hour), "Jane@Example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pollDatabase(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := hsGet(jane[0]); got.Checksum == first.Checksum {
+		t.Error("Want the updated photo cached")
+	}
+
+	if !dbCursor.Equal(base.Add(time.Hour)) {
+		t.Errorf("Want cursor moved to %v, got %v", base.Add(time.Hour), dbCursor)
+	}
+
+	// the second hash is evicted, its photo is still known to the source
+	hsDelete(jane[1])
+
+	src := databaseSource{}
+	av, err := src.lookup(context.Background(), lookupRequest{hash: jane[1]})
+	if err != nil || av.Source != sourceDatabase {
+		t.Errorf("Want photo from the database, got source '%s' (%v)", av.Source, err)
+	}
+
+	// the ingest time identifies the pre-rendered ladder of the photo
+	if updated := hsGet(jane[0]).LastUpdate; !av.LastUpdate.Equal(updated) {
+		t.Errorf("Want the photo ingested at %v, got %v", updated, av.LastUpdate)
+	}
+
+	nobody := emailHashes("nobody@example.com")[0]
+	if _, err := src.lookup(context.Background(), lookupRequest{hash: nobody}); !errors.Is(err, errNotFound) {
+		t.Errorf("Want not found for an unknown hash, got %v", err)
+	}
+
+	// a cleared image removes the photo
+	if _, err := db.Exec(`UPDATE portraits SET photo = NULL, updated_at = ? WHERE email = ?`,
+		base.Add(2*time.Hour), "Jane@Example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pollDatabase(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := src.lookup(context.Background(), lookupRequest{hash: jane[0]}); !errors.Is(err, errNotFound) {
+		t.Errorf("Want the cleared photo removed, got %v", err)
+	}
+
+	if got := hsGet(jane[0]); len(got.Image) > 0 {
+		t.Errorf("Want the cleared photo dropped from the cache, got source '%s'", got.Source)
+	}
+}
+
+func TestDatabaseExpiry(t *testing.T) {
+	t.Setenv("SOURCE_TTLS", "database=60")
+	parseTestConfig(t)
+
+	old := avatar{Image: []byte("x"), LastUpdate: time.Now().Add(-time.Hour), Source: sourceDatabase}
+
+	t.Cleanup(func() { dbPolled = time.Time{} })
+
+	dbPolled = time.Time{}
+	if !old.expired() {
+		t.Error("Want a photo ingested before SOURCE_TTLS expired without polls")
+	}
+
+	// a poll since would have replaced an outdated photo
+	dbPolled = time.Now()
+	if old.expired() {
+		t.Error("Want the photo current after a poll")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// photoSettle is how long a photo file has to stay unchanged before it is
+// read, so files being copied are not ingested half-written.
+const photoSettle = 250 * time.Millisecond
+
+var (
+	// photoFiles maps the hashes of photos named by hash or email and the
+	// uids of photos named by uid to their file names
+	photoFiles   = map[string]string{}
+	photoFilesMu sync.RWMutex
+
+	// photoExts are the extensions of the photo files read
+	photoExts = map[string]bool{".gif": true, ".jpeg": true, ".jpg": true, ".png": true}
+
+	// uids maps the hashes of LDAP users to their uid, filled by fillHash
+	uids = map[string]string{}
+
+	photoTimers   = map[string]*time.Timer{}
+	photoTimersMu sync.Mutex
+)
+
+func uidWrite(h, uid string) {
+	lock.Lock()
+	uids[h] = uid
+	lock.Unlock()
+}
+
+func uidGet(h string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return uids[h]
+}
+
+// uidHashes returns the hashes of the LDAP user with uid.
+func uidHashes(uid string) []string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var hashes []string
+
+	for h, u := range uids {
+		if strings.EqualFold(u, uid) {
+			hashes = append(hashes, h)
+		}
+	}
+
+	return hashes
+}
+
+func isHash(s string) bool {
+	_, err := hex.DecodeString(s)
+
+	return err == nil && (len(s) == 32 || len(s) == 64)
+}
+
+// photoKeys returns the keys a photo file is indexed by: the file name
+// without the extension is a hash, an email (indexed by its hashes) or a
+// uid. Files of other types give no keys.
+func photoKeys(name string) []string {
+	ext := filepath.Ext(name)
+	if !photoExts[strings.ToLower(ext)] || strings.HasPrefix(name, ".") {
+		return nil
+	}
+
+	stem := strings.ToLower(strings.TrimSpace(strings.TrimSuffix(name, ext)))
+
+	switch {
+	case len(stem) == 0:
+		return nil
+	case isHash(stem):
+		return []string{stem}
+	case strings.Contains(stem, "@"):
+		return emailHashes(stem)
+	}
+
+	return []string{stem}
+}
+
+// scanPhotoDir indexes the photo files of PHOTO_DIRECTORY.
+func scanPhotoDir() error {
+	entries, err := os.ReadDir(cfg.PhotoDir)
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		for _, key := range photoKeys(entry.Name()) {
+			files[key] = entry.Name()
+		}
+	}
+
+	photoFilesMu.Lock()
+	photoFiles = files
+	photoFilesMu.Unlock()
+
+	return nil
+}
+
+// readPhoto returns the photo file of a hash: named by the hash itself, by
+// its email or by the uid of its LDAP user.
+func readPhoto(h string) ([]byte, error) {
+	photoFilesMu.RLock()
+	name, ok := photoFiles[h]
+	if !ok {
+		if uid := uidGet(h); len(uid) > 0 {
+			name, ok = photoFiles[strings.ToLower(uid)]
+		}
+	}
+	photoFilesMu.RUnlock()
+
+	if !ok {
+		return nil, errNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.PhotoDir, name)) // #nosec G304
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+
+	return data, err
+}
+
+// directoryPhoto returns the photo file of an LDAP user without a photo in
+// LDAP, looked up by any of its hashes or its uid.
+func directoryPhoto(hashes []string) []byte {
+	if len(cfg.PhotoDir) == 0 {
+		return nil
+	}
+
+	for _, h := range hashes {
+		if data, err := readPhoto(h); err == nil {
+			return data
+		}
+	}
+
+	return nil
+}
+
+// applyPhoto updates the index and the cache after the photo file name was
+// created, changed or removed. Photos from LDAP are left alone.
+func applyPhoto(name string) {
+	keys := photoKeys(name)
+	if len(keys) == 0 {
+		return
+	}
+
+	hashes := keys
+	if !isHash(keys[0]) {
+		hashes = uidHashes(keys[0])
+	}
+
+	info, err := os.Stat(filepath.Join(cfg.PhotoDir, name))
+	exists := err == nil && info.Mode().IsRegular()
+
+	photoFilesMu.Lock()
+	for _, key := range keys {
+		if exists {
+			photoFiles[key] = name
+		} else if photoFiles[key] == name {
+			delete(photoFiles, key)
+		}
+	}
+	photoFilesMu.Unlock()
+
+	var stale []string
+
+	for _, h := range hashes {
+		if cached := hsGet(h); cached.Source != sourceLDAP {
+			stale = append(stale, h)
+		}
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+
+	if !exists {
+		for _, h := range stale {
+			if hsGet(h).Source == sourceDirectory {
+				fmt.Fprintln(os.Stderr, h+" × directory")
+				hsDelete(h)
+			}
+		}
+
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.PhotoDir, name)) // #nosec G304
+	if err != nil {
+		fmt.Fprintln(os.Stderr, name+" × directory: "+err.Error())
+
+		return
+	}
+
+	av := ingestAvatar(data, sourceDirectory, stale...)
+	for _, h := range stale {
+		fmt.Fprintln(os.Stderr, h+" → directory")
+		hsWrite(h, av)
+	}
+	queueRender(av, stale...)
+}
+
+// settlePhoto applies a change of the photo file name once it has settled.
+func settlePhoto(name string) {
+	photoTimersMu.Lock()
+	defer photoTimersMu.Unlock()
+
+	if t, ok := photoTimers[name]; ok {
+		t.Reset(photoSettle)
+
+		return
+	}
+
+	photoTimers[name] = time.AfterFunc(photoSettle, func() {
+		photoTimersMu.Lock()
+		delete(photoTimers, name)
+		photoTimersMu.Unlock()
+
+		applyPhoto(name)
+	})
+}
+
+// watchPhotoDir indexes PHOTO_DIRECTORY and keeps the index and the cache up
+// to date as files are dropped into it, changed or removed.
+func watchPhotoDir() (*fsnotify.Watcher, error) {
+	if err := scanPhotoDir(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watcher.Add(cfg.PhotoDir); err != nil {
+		_ = watcher.Close()
+
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				settlePhoto(filepath.Base(event.Name))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Fprintln(os.Stderr, "× directory: "+err.Error())
+
+				// events may have been lost, read the directory again
+				if err := scanPhotoDir(); err != nil {
+					fmt.Fprintln(os.Stderr, "× directory: "+err.Error())
+				}
+			}
+		}
+	}()
+
+	return watcher, nil
+}
+
+type directorySource struct{}
+
+func (directorySource) name() string {
+	return sourceDirectory
+}
+
+func (directorySource) lookup(_ context.Context, req lookupRequest) (avatar, error) {
+	data, err := readPhoto(req.hash)
+	if err != nil {
+		return avatar{}, err
+	}
+
+	return ingestAvatar(data, sourceDirectory, req.hash), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPhotoKeys(t *testing.T) {
+	tests := map[string][]string{
+		"ABABABABABABABABABABABABABABABAB.jpg": {"abababababababababababababababab"},
+		"Jane@Example.com.PNG":                 emailHashes("jane@example.com"),
+		"jdoe.jpeg":                            {"jdoe"},
+		"jdoe.txt":                             nil,
+		".jdoe.jpg.swp":                        nil,
+		".jpg":                                 nil,
+	}
+
+	for name, want := range tests {
+		if got := photoKeys(name); !slices.Equal(got, want) {
+			t.Errorf("%s: want %v, got %v", name, want, got)
+		}
+	}
+}
+
+func writePhoto(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(cfg.PhotoDir, name), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectorySource(t *testing.T) {
+	const h string = "abababababababababababababababab"
+
+	t.Setenv("PHOTO_DIRECTORY", t.TempDir())
+	parseTestConfig(t)
+
+	mail := emailHashes("jane@example.com")
+	uid := emailHashes("john@example.com")
+
+	writePhoto(t, h+".jpg", testJpeg(t, 40, 40))
+	writePhoto(t, "jane@example.com.jpg", testJpeg(t, 50, 50))
+	writePhoto(t, "jdoe.jpg", testJpeg(t, 60, 60))
+
+	if err := scanPhotoDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	uids = map[string]string{}
+	for _, hash := range uid {
+		uidWrite(hash, "JDoe")
+	}
+
+	src := directorySource{}
+
+	for _, hash := range []string{h, mail[0], mail[1], uid[0], uid[1]} {
+		av, err := src.lookup(context.Background(), lookupRequest{hash: hash})
+		if err != nil || av.Source != sourceDirectory || len(av.Image) == 0 {
+			t.Errorf("%s: want photo from directory, got source '%s' (%v)", hash, av.Source, err)
+		}
+	}
+
+	_, err := src.lookup(context.Background(), lookupRequest{hash: emailHashes("nobody@example.com")[0]})
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("Want not found for hash without a file, got %v", err)
+	}
+
+	if got := directoryPhoto(uid); len(got) == 0 {
+		t.Error("Want the photo of an LDAP user found by uid")
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+
+	t.Fatal("Timed out waiting for " + what)
+}
+
+func TestWatchPhotoDir(t *testing.T) {
+	t.Setenv("PHOTO_DIRECTORY", t.TempDir())
+	parseTestConfig(t)
+
+	mail := emailHashes("jane@example.com")
+	ldap := emailHashes("eve@example.com")
+
+	hs = map[string]avatar{
+		ldap[0]: {Image: testJpeg(t, 30, 30), LastUpdate: time.Now(), Source: sourceLDAP},
+	}
+
+	watcher, err := watchPhotoDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	writePhoto(t, "jane@example.com.jpg", testJpeg(t, 50, 50))
+	writePhoto(t, "eve@example.com.jpg", testJpeg(t, 50, 50))
+
+	waitFor(t, "the dropped photo", func() bool {
+		return hsGet(mail[0]).Source == sourceDirectory && hsGet(mail[1]).Source == sourceDirectory
+	})
+
+	waitFor(t, "the photo of a hash with an LDAP photo", func() bool {
+		return hsGet(ldap[1]).Source == sourceDirectory
+	})
+
+	if got := hsGet(ldap[0]).Source; got != sourceLDAP {
+		t.Errorf("Want LDAP photos kept, got source '%s'", got)
+	}
+
+	if err := os.Remove(filepath.Join(cfg.PhotoDir, "jane@example.com.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the removed photo", func() bool {
+		return len(hsGet(mail[0]).Image) == 0
+	})
+
+	if _, err := readPhoto(mail[0]); !errors.Is(err, errNotFound) {
+		t.Errorf("Want the removed photo dropped from the index, got %v", err)
+	}
+}
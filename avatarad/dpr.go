@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	acceptCHHeader = "Accept-CH"
+	dprHeader      = "DPR"
+	secDPRHeader   = "Sec-CH-DPR"
+	maxDPR         = 4
+)
+
+// srcsetParams are the query parameters copied from a srcset request to the
+// avatar URLs it returns: all those changing the image, except the size.
+var srcsetParams = []string{"fit", "bg", "shape", "static", "d", "default", "f", "forcedefault", "domain"}
+
+type srcset struct {
+	Src    string `json:"src"`
+	Srcset string `json:"srcset"`
+	Width  uint64 `json:"width"`
+	Height uint64 `json:"height"`
+	Img    string `json:"img"`
+}
+
+// srcsetDensities are the parsed SRCSET_DENSITIES.
+var srcsetDensities []float64
+
+func checkDPRConfig() error {
+	srcsetDensities = srcsetDensities[:0]
+
+	for _, s := range cfg.SrcsetDensities {
+		d, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || d < 1 || d > maxDPR {
+			return fmt.Errorf("SRCSET_DENSITIES must be numbers within 1…%d", maxDPR)
+		}
+
+		srcsetDensities = append(srcsetDensities, d)
+	}
+
+	return nil
+}
+
+func parseDPR(s string) (float64, error) {
+	dpr, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(dpr) || dpr <= 0 {
+		return 1, errors.New("invalid device pixel ratio " + s)
+	}
+
+	return min(max(dpr, 1), maxDPR), nil
+}
+
+// requestDPR returns the device pixel ratio the avatar is displayed at: the
+// dpr query parameter wins over the Sec-CH-DPR and DPR client hints. Broken
+// hints are ignored, a broken parameter is an error. Ratios below 1 are
+// raised to 1, so hints never make avatars smaller than requested.
+func requestDPR(r *http.Request) (float64, error) {
+	if d := r.URL.Query().Get("dpr"); len(d) > 0 {
+		return parseDPR(d)
+	}
+
+	for _, h := range []string{secDPRHeader, dprHeader} {
+		if d := r.Header.Get(h); len(d) > 0 {
+			if dpr, err := parseDPR(d); err == nil {
+				return dpr, nil
+			}
+		}
+	}
+
+	return 1, nil
+}
+
+// scaleSize multiplies the requested size by dpr before it is clamped.
+func scaleSize(size uint64, dpr float64) uint64 {
+	return uint64(math.Round(float64(size) * dpr))
+}
+
+func writeClientHintHeaders(w http.ResponseWriter) {
+	w.Header().Set(acceptCHHeader, secDPRHeader+", "+dprHeader)
+}
+
+// newSrcset builds the responsive image markup for the avatar at path with
+// the given CSS size: one URL per configured density, larger ones are left
+// out when they exceed MAX_SIZE.
+func newSrcset(path string, size uint64, q url.Values) srcset {
+	avatarURL := func(s uint64) string {
+		v := url.Values{"s": {strconv.FormatUint(s, 10)}}
+		for _, p := range srcsetParams {
+			if len(q.Get(p)) > 0 {
+				v.Set(p, q.Get(p))
+			}
+		}
+
+		return strings.TrimSuffix(cfg.PublicURL, "/") + path + "?" + v.Encode()
+	}
+
+	set := srcset{Src: avatarURL(size), Width: size, Height: size}
+
+	var candidates []string
+
+	for _, d := range srcsetDensities {
+		s := scaleSize(size, d)
+		if s > cfg.MaxSize && d > 1 {
+			continue
+		}
+
+		candidates = append(candidates, avatarURL(s)+" "+strconv.FormatFloat(d, 'f', -1, 64)+"x")
+	}
+
+	set.Srcset = strings.Join(candidates, ", ")
+	set.Img = fmt.Sprintf(`<img src="%s" srcset="%s" width="%d" height="%d" alt="%s">`,
+		html.EscapeString(set.Src), html.EscapeString(set.Srcset), size, size, html.EscapeString(q.Get("alt")))
+
+	return set
+}
+
+func srcsetHandler(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintln(os.Stderr, r)
+		}
+	}()
+
+	writeSecurityHeaders(w)
+
+	q := r.URL.Query()
+	name := strings.TrimPrefix(r.URL.Path, "/srcset/")
+	_, ext, _ := strings.Cut(name, ".")
+	if _, ok := extFormats[strings.ToLower(ext)]; !ok || len(name) == 0 || strings.Contains(name, "/") {
+		http.Error(w, "invalid avatar", http.StatusBadRequest)
+
+		return
+	}
+
+	set := newSrcset("/avatar/"+url.PathEscape(name), clampSize(querySize(q)), q)
+
+	// the snippet is meant to be pasted into HTML as is
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	w.Header().Set(contentType, "application/json; charset=utf-8")
+	if err := enc.Encode(set); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestDPR(t *testing.T) {
+	tests := []struct {
+		query   string
+		headers map[string]string
+		want    float64
+		err     bool
+	}{
+		{"", nil, 1, false},
+		{"", map[string]string{"Sec-CH-DPR": "2"}, 2, false},
+		{"", map[string]string{"DPR": "1.5"}, 1.5, false},
+		{"", map[string]string{"Sec-CH-DPR": "3", "DPR": "2"}, 3, false},
+		{"", map[string]string{"Sec-CH-DPR": "bogus", "DPR": "2"}, 2, false},
+		{"", map[string]string{"DPR": "0.5"}, 1, false},
+		{"", map[string]string{"DPR": "10"}, maxDPR, false},
+		{"?dpr=2.5", map[string]string{"Sec-CH-DPR": "3"}, 2.5, false},
+		{"?dpr=abc", nil, 1, true},
+		{"?dpr=0", nil, 1, true},
+		{"?dpr=NaN", nil, 1, true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/avatar/x"+tt.query, nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+
+		got, err := requestDPR(r)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("%s %v: want %v (error %t), got %v (%v)", tt.query, tt.headers, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+func TestHandleAvatarDPR(t *testing.T) {
+	const m string = "99999999999999999999999999999999"
+
+	t.Setenv("MAX_SIZE", "200")
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testJpeg(t, 120, 160), LastUpdate: time.Now()}}
+
+	tests := []struct {
+		query string
+		dpr   string
+		code  int
+		size  int
+	}{
+		{"?s=40", "", http.StatusOK, 40},
+		{"?s=40", "2", http.StatusOK, 80},
+		{"?s=40&dpr=3", "2", http.StatusOK, 120},
+		{"?s=150", "2", http.StatusOK, 200},
+		{"?s=40&dpr=x", "", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/avatar/"+m+tt.query, nil)
+		if len(tt.dpr) > 0 {
+			r.Header.Set("Sec-CH-DPR", tt.dpr)
+		}
+
+		avatarHandler(w, r)
+
+		if w.Code != tt.code {
+			t.Errorf("%s: want response code %d, got %d", tt.query, tt.code, w.Code)
+
+			continue
+		}
+
+		if got := w.Header().Get("Accept-CH"); !strings.Contains(got, "Sec-CH-DPR") {
+			t.Errorf("%s: want Accept-CH to list Sec-CH-DPR, got '%s'", tt.query, got)
+		}
+
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		if got := w.Header().Values("Vary"); len(got) < 2 || !strings.Contains(got[1], "Sec-CH-DPR") {
+			t.Errorf("%s: want Vary to list the client hints, got %v", tt.query, got)
+		}
+
+		ic, _, err := image.DecodeConfig(w.Body)
+		if err != nil || ic.Width != tt.size {
+			t.Errorf("%s (DPR %s): want %d pixels wide image, got %d (%v)", tt.query, tt.dpr, tt.size, ic.Width, err)
+		}
+	}
+}
+
+func TestHandleSrcset(t *testing.T) {
+	const m string = "99999999999999999999999999999999"
+
+	t.Setenv("MAX_SIZE", "150")
+	t.Setenv("PUBLIC_URL", "https://avatars.example.org/")
+	parseTestConfig(t)
+
+	w := httptest.NewRecorder()
+	q := "?s=64&fit=pad&shape=circle&d=identicon&f=y&alt=%22Eve%22"
+	srcsetHandler(w, httptest.NewRequest("GET", "/srcset/"+m+".png"+q, nil))
+
+	if got, want := w.Header().Get("Content-Type"), "application/json; charset=utf-8"; got != want {
+		t.Errorf("Want content type '%s', got '%s'", want, got)
+	}
+
+	var set srcset
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatalf("%v while decoding response", err)
+	}
+
+	// the options changing the image are kept, in url.Values.Encode order
+	avatarURL := func(size string) string {
+		return "https://avatars.example.org/avatar/" + m + ".png?d=identicon&f=y&fit=pad&s=" + size + "&shape=circle"
+	}
+
+	if got, want := set.Src, avatarURL("64"); got != want {
+		t.Errorf("Want src '%s', got '%s'", want, got)
+	}
+
+	// 3x exceeds MAX_SIZE and is left out
+	if got, want := set.Srcset, avatarURL("64")+" 1x, "+avatarURL("128")+" 2x"; got != want {
+		t.Errorf("Want srcset '%s', got '%s'", want, got)
+	}
+
+	if set.Width != 64 || set.Height != 64 {
+		t.Errorf("Want 64×64, got %d×%d", set.Width, set.Height)
+	}
+
+	srcsetAttr := `srcset="` + strings.ReplaceAll(avatarURL("64"), "&", "&amp;") + ` 1x`
+	for _, want := range []string{`width="64"`, `alt="&#34;Eve&#34;"`, srcsetAttr} {
+		if !strings.Contains(set.Img, want) {
+			t.Errorf("Want %s in '%s'", want, set.Img)
+		}
+	}
+
+	for _, path := range []string{"/srcset/", "/srcset/" + m + ".bmp", "/srcset/" + m + "/x"} {
+		w := httptest.NewRecorder()
+		srcsetHandler(w, httptest.NewRequest("GET", path, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: want response code %d, got %d", path, http.StatusBadRequest, w.Code)
+		}
+	}
+}
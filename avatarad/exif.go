@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+const (
+	orientationTag  = 0x0112
+	orientationNone = 1
+	ifdEntrySize    = 12
+	tiffHeaderSize  = 8
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegSegments calls fn for every metadata segment of JPEG data until fn
+// returns false or the image data starts.
+func jpegSegments(data []byte, fn func(marker byte, segment []byte) bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return
+	}
+
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		// start of scan: no more metadata segments
+		if marker == 0xda || length < 2 || i+2+length > len(data) {
+			return
+		}
+
+		if !fn(marker, data[i+4:i+2+length]) {
+			return
+		}
+
+		i += 2 + length
+	}
+}
+
+// jpegOrientation returns the EXIF orientation (1–8) of JPEG data, or 1 if
+// data is not a JPEG or carries no valid orientation tag.
+func jpegOrientation(data []byte) int {
+	orientation := orientationNone
+
+	jpegSegments(data, func(marker byte, segment []byte) bool {
+		if marker == 0xe1 && bytes.HasPrefix(segment, exifHeader) {
+			orientation = tiffOrientation(segment[len(exifHeader):])
+
+			return false
+		}
+
+		return true
+	})
+
+	return orientation
+}
+
+// tiffOrientation looks the orientation tag up in IFD0 of a TIFF structure.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < tiffHeaderSize {
+		return orientationNone
+	}
+
+	var order binary.ByteOrder
+
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return orientationNone
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < tiffHeaderSize || ifd+2 > len(tiff) {
+		return orientationNone
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := range count {
+		entry := ifd + 2 + n*ifdEntrySize
+		if entry+ifdEntrySize > len(tiff) {
+			break
+		}
+
+		if order.Uint16(tiff[entry:]) != orientationTag {
+			continue
+		}
+
+		if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+			return o
+		}
+
+		break
+	}
+
+	return orientationNone
+}
+
+// applyOrientation transforms img so that it is displayed upright for the
+// given EXIF orientation.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= orientationNone || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// orientations 5–8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := range h {
+		for x := range w {
+			var dx, dy int
+
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+
+			si, di := src.PixOffset(x, y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+
+	return dst
+}
+
+// decodeImage decodes avatar data to sRGB honouring the EXIF orientation of
+// JPEGs. Data exceeding the configured limits is rejected before decoding.
+// Metadata never survives decoding: whatever is served is re-encoded from
+// the pixels only, so GPS positions, camera details, XMP and IPTC blocks of
+// the original are dropped.
+func decodeImage(data []byte) (image.Image, string, error) {
+	if err := checkImage(data); err != nil {
+		return nil, "", err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, format, err
+	}
+
+	img = toSRGB(img, embeddedICC(data, format))
+
+	if format == formatJpeg {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	return img, format, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withExif inserts an EXIF segment with the given orientation and a fake
+// GPS marker string right after the JPEG SOI marker.
+func withExif(t *testing.T, data []byte, order binary.ByteOrder, orientation uint16) []byte {
+	t.Helper()
+
+	tiff := new(bytes.Buffer)
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+
+	fields := []any{
+		uint16(42), uint32(8), // header and offset of the first IFD
+		uint16(1), uint16(orientationTag), uint16(3), uint32(1), orientation, uint16(0), // one SHORT entry
+		uint32(0), // no next IFD
+	}
+	for _, v := range fields {
+		if err := binary.Write(tiff, order, v); err != nil {
+			t.Fatalf("%v while writing test EXIF", err)
+		}
+	}
+
+	tiff.WriteString("GPS 55.7558N 37.6173E")
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	out := []byte{0xff, 0xd8, 0xff, 0xe1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+
+	return append(out, data[2:]...)
+}
+
+func TestJpegOrientation(t *testing.T) {
+	data := testJpeg(t, 30, 20)
+
+	if got := jpegOrientation(data); got != orientationNone {
+		t.Errorf("Want orientation %d without EXIF, got %d", orientationNone, got)
+	}
+
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		for o := range uint16(8) {
+			if got := jpegOrientation(withExif(t, data, order, o+1)); got != int(o+1) {
+				t.Errorf("%v: want orientation %d, got %d", order, o+1, got)
+			}
+		}
+	}
+
+	for _, data := range [][]byte{nil, []byte("GIF89a"), withExif(t, data, binary.BigEndian, 9)[:30]} {
+		if got := jpegOrientation(data); got != orientationNone {
+			t.Errorf("Want orientation %d for broken data, got %d", orientationNone, got)
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// 2×1 image: red pixel on the left, blue one on the right
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	tests := []struct {
+		orientation int
+		size        image.Point
+		red         image.Point
+	}{
+		{1, image.Pt(2, 1), image.Pt(0, 0)},
+		{2, image.Pt(2, 1), image.Pt(1, 0)},
+		{3, image.Pt(2, 1), image.Pt(1, 0)},
+		{4, image.Pt(2, 1), image.Pt(0, 0)},
+		{5, image.Pt(1, 2), image.Pt(0, 0)},
+		{6, image.Pt(1, 2), image.Pt(0, 0)},
+		{7, image.Pt(1, 2), image.Pt(0, 1)},
+		{8, image.Pt(1, 2), image.Pt(0, 1)},
+	}
+
+	for _, tt := range tests {
+		got := applyOrientation(src, tt.orientation)
+
+		if got.Bounds().Size() != tt.size {
+			t.Errorf("%d: want size %v, got %v", tt.orientation, tt.size, got.Bounds().Size())
+
+			continue
+		}
+
+		if c := color.NRGBAModel.Convert(got.At(tt.red.X, tt.red.Y)); c != red {
+			t.Errorf("%d: want red pixel at %v, got %v", tt.orientation, tt.red, c)
+		}
+	}
+}
+
+func TestHandleAvatarExif(t *testing.T) {
+	const m string = "33333333333333333333333333333333"
+
+	parseTestConfig(t)
+
+	// a sideways 160×120 photo that should be displayed as 120×160
+	hs = map[string]avatar{m: {Image: withExif(t, testJpeg(t, 160, 120), binary.BigEndian, 6), LastUpdate: time.Now()}}
+
+	for _, query := range []string{"?s=60&fit=contain", "?s=120&fit=contain"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/avatar/"+m+query, nil)
+
+		avatarHandler(w, r)
+
+		body := w.Body.Bytes()
+		if bytes.Contains(body, []byte("Exif")) || bytes.Contains(body, []byte("GPS")) {
+			t.Errorf("%s: response leaks EXIF metadata", query)
+		}
+
+		ic, _, err := image.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %v while decoding response body", query, err)
+		}
+
+		if ic.Width >= ic.Height {
+			t.Errorf("%s: want portrait image, got %dx%d", query, ic.Width, ic.Height)
+		}
+	}
+}
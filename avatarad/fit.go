@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const (
+	fitContain = "contain"
+	fitCrop    = "crop"
+	fitPad     = "pad"
+	fitStretch = "stretch"
+)
+
+var errBadColor = errors.New("color must be RRGGBB or RRGGBBAA hex value")
+
+var fitModes = map[string]bool{
+	fitContain: true,
+	fitCrop:    true,
+	fitPad:     true,
+	fitStretch: true,
+}
+
+// parseColor parses RRGGBB or RRGGBBAA hex notation, an optional leading
+// '#' is ignored.
+func parseColor(s string) (color.NRGBA, error) {
+	if len(s) > 0 && s[0] == '#' {
+		s = s[1:]
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != 3 && len(b) != 4) {
+		return color.NRGBA{}, errBadColor
+	}
+
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 0xff}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+
+	return c, nil
+}
+
+// scaleToFit resizes img so that its longer side equals size.
+func scaleToFit(img image.Image, size uint, filter string) image.Image {
+	if img.Bounds().Dx() >= img.Bounds().Dy() {
+		return scaleImage(img, size, 0, filter)
+	}
+
+	return scaleImage(img, 0, size, filter)
+}
+
+// centerSquare returns the largest square in the middle of r.
+func centerSquare(r image.Rectangle) image.Rectangle {
+	side := min(r.Dx(), r.Dy())
+	x := r.Min.X + (r.Dx()-side)/2
+	y := r.Min.Y + (r.Dy()-side)/2
+
+	return image.Rect(x, y, x+side, y+side)
+}
+
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+
+	return dst
+}
+
+// fitImage resizes img with the named filter into a size×size box according
+// to mode:
+//   - crop cuts the crop box (or the centered square if crop is empty or
+//     does not fit img) out of img and scales it (Gravatar-like);
+//   - pad scales img to fit the box and fills the rest with bg;
+//   - contain scales img to fit the box keeping its aspect ratio, so the
+//     result is not square for non-square sources;
+//   - stretch scales img to the box ignoring its aspect ratio.
+func fitImage(
+	img image.Image, size uint, mode string, bg color.Color, crop image.Rectangle, filter string,
+) image.Image {
+	switch mode {
+	case fitContain:
+		return scaleToFit(img, size, filter)
+	case fitPad:
+		scaled := scaleToFit(img, size, filter)
+		dst := image.NewRGBA(image.Rect(0, 0, int(size), int(size)))
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+		offset := image.Pt((int(size)-scaled.Bounds().Dx())/2, (int(size)-scaled.Bounds().Dy())/2)
+		draw.Draw(dst, scaled.Bounds().Sub(scaled.Bounds().Min).Add(offset), scaled, scaled.Bounds().Min, draw.Over)
+
+		return dst
+	case fitStretch:
+		return scaleImage(img, size, size, filter)
+	default:
+		if crop.Empty() || !crop.In(img.Bounds()) {
+			crop = centerSquare(img.Bounds())
+		}
+
+		return scaleImage(cropImage(img, crop), size, size, filter)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := map[string]color.NRGBA{
+		"ffffff":    {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		"#102030":   {R: 0x10, G: 0x20, B: 0x30, A: 0xff},
+		"10203040":  {R: 0x10, G: 0x20, B: 0x30, A: 0x40},
+		"#00000000": {},
+	}
+
+	for s, want := range tests {
+		got, err := parseColor(s)
+		if err != nil {
+			t.Errorf("parseColor(%q): %v", s, err)
+		}
+
+		if got != want {
+			t.Errorf("parseColor(%q): want %v, got %v", s, want, got)
+		}
+	}
+
+	for _, s := range []string{"", "fff", "white", "#1020304050"} {
+		if _, err := parseColor(s); err == nil {
+			t.Errorf("parseColor(%q): want error", s)
+		}
+	}
+}
+
+func TestFitImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 120, 160))
+	bg := color.NRGBA{R: 0xff, A: 0xff}
+
+	tests := map[string]image.Point{
+		fitCrop:    {80, 80},
+		fitPad:     {80, 80},
+		fitContain: {60, 80},
+		fitStretch: {80, 80},
+	}
+
+	for mode, want := range tests {
+		if got := fitImage(src, 80, mode, bg, image.Rectangle{}, filterLanczos3).Bounds().Size(); got != want {
+			t.Errorf("%s: want size %v, got %v", mode, want, got)
+		}
+	}
+
+	padded := fitImage(src, 80, fitPad, bg, image.Rectangle{}, filterLanczos3)
+	if got := color.NRGBAModel.Convert(padded.At(0, 40)); got != bg {
+		t.Errorf("pad: want background %v, got %v", bg, got)
+	}
+}
+
+func TestFitImageCropBox(t *testing.T) {
+	src := testPortrait(image.Rect(0, 0, 120, 160), image.Rect(0, 0, 120, 120))
+
+	got := fitImage(src, 40, fitCrop, color.White, image.Rect(0, 0, 120, 120), filterLanczos3)
+	if c := color.RGBAModel.Convert(got.At(20, 39)); c != testSkin {
+		t.Errorf("Want crop box colour %v at the bottom, got %v", testSkin, c)
+	}
+
+	// crop boxes outside the image fall back to the centered square
+	got = fitImage(src, 40, fitCrop, color.White, image.Rect(0, 100, 120, 220), filterLanczos3)
+	if c := color.RGBAModel.Convert(got.At(20, 39)); c != testBackground {
+		t.Errorf("Want background colour %v at the bottom, got %v", testBackground, c)
+	}
+}
+
+func TestHandleAvatarFit(t *testing.T) {
+	const m string = "11111111111111111111111111111111"
+
+	t.Setenv("FIT_MODE", fitContain)
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testJpeg(t, 120, 160), LastUpdate: time.Now()}}
+
+	tests := map[string]image.Point{
+		"":          {60, 80},
+		"&fit=crop": {80, 80},
+		"&fit=pad":  {80, 80},
+	}
+
+	for query, want := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/avatar/"+m+"?s=80"+query, nil)
+
+		avatarHandler(w, r)
+
+		ic, _, err := image.DecodeConfig(w.Body)
+		if err != nil {
+			t.Errorf("%q: %v while decoding response body", query, err)
+
+			continue
+		}
+
+		if got := image.Pt(ic.Width, ic.Height); got != want {
+			t.Errorf("%q: want size %v, got %v", query, want, got)
+		}
+	}
+
+	for _, query := range []string{"?fit=zoom", "?bg=white"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/avatar/"+m+query, nil)
+
+		avatarHandler(w, r)
+
+		if got, want := w.Code, http.StatusBadRequest; want != got {
+			t.Errorf("%q: want response code %d, got %d", query, want, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/gif"
+)
+
+// decodeAnimation returns the decoded GIF if data holds an animation with
+// more than one frame and nil otherwise.
+func decodeAnimation(data []byte) *gif.GIF {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil || len(g.Image) < 2 {
+		return nil
+	}
+
+	return g
+}
+
+// resizeAnimation applies fn to every frame of g and returns a new animation
+// with the same timing and loop count. Frames are composited on a canvas
+// honouring their disposal methods first, so partial frames come out right.
+func resizeAnimation(g *gif.GIF, fn func(image.Image) image.Image) *gif.GIF {
+	out := &gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(g.Image)),
+		Delay:     make([]int, 0, len(g.Image)),
+		Disposal:  make([]byte, 0, len(g.Image)),
+		LoopCount: g.LoopCount,
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		resized := fn(canvas)
+		bounds := resized.Bounds().Sub(resized.Bounds().Min)
+		paletted := image.NewPaletted(bounds, frame.Palette)
+		draw.FloydSteinberg.Draw(paletted, bounds, resized, resized.Bounds().Min)
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, g.Delay[i])
+		// every output frame covers the whole canvas
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	out.Config = image.Config{
+		ColorModel: out.Image[0].Palette,
+		Width:      out.Image[0].Bounds().Dx(),
+		Height:     out.Image[0].Bounds().Dy(),
+	}
+
+	return out
+}
+
+func encodeAnimation(g *gif.GIF) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gif.EncodeAll(buf, g)
+
+	return buf.Bytes(), err
+}
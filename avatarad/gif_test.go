@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAnimation(t *testing.T) []byte {
+	t.Helper()
+
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 100, 100), palette.Plan9),
+			image.NewPaletted(image.Rect(20, 20, 60, 60), palette.Plan9),
+			image.NewPaletted(image.Rect(0, 0, 100, 100), palette.Plan9),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground},
+		LoopCount: 3,
+	}
+	for i, c := range []color.Color{color.White, color.Black, color.RGBA{R: 255, A: 255}} {
+		frame := g.Image[i]
+		for y := frame.Rect.Min.Y; y < frame.Rect.Max.Y; y++ {
+			for x := frame.Rect.Min.X; x < frame.Rect.Max.X; x++ {
+				frame.Set(x, y, c)
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatalf("%v while encoding test animation", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestHandleAvatarAnimated(t *testing.T) {
+	const m string = "22222222222222222222222222222222"
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testAnimation(t), LastUpdate: time.Now()}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/avatar/"+m+"?s=40", nil)
+	r.Header.Set("Accept", "image/webp,*/*")
+
+	avatarHandler(w, r)
+
+	if got, want := w.Header().Get("Content-Type"), "image/gif"; got != want {
+		t.Errorf("Want content type '%s', got '%s'", want, got)
+	}
+
+	g, err := gif.DecodeAll(w.Body)
+	if err != nil {
+		t.Fatalf("%v while decoding response body", err)
+	}
+
+	if got, want := len(g.Image), 3; got != want {
+		t.Fatalf("Want %d frames, got %d", want, got)
+	}
+
+	if got, want := g.LoopCount, 3; got != want {
+		t.Errorf("Want loop count %d, got %d", want, got)
+	}
+
+	for i, want := range []int{10, 20, 30} {
+		if got := g.Delay[i]; got != want {
+			t.Errorf("Frame %d: want delay %d, got %d", i, want, got)
+		}
+
+		if got := g.Image[i].Bounds(); got != image.Rect(0, 0, 40, 40) {
+			t.Errorf("Frame %d: want full 40x40 frame, got %v", i, got)
+		}
+	}
+
+	// the partial second frame is drawn over the white first one
+	if r, _, _, _ := g.Image[1].At(2, 2).RGBA(); r>>8 < 0xf0 {
+		t.Errorf("Frame 1 lost the composited background")
+	}
+}
+
+func TestHandleAvatarAnimatedStatic(t *testing.T) {
+	const m string = "22222222222222222222222222222222"
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testAnimation(t), LastUpdate: time.Now()}}
+
+	for _, url := range []string{"/avatar/" + m + "?static=1", "/avatar/" + m + ".png"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+
+		avatarHandler(w, r)
+
+		if strings.HasSuffix(url, ".png") {
+			if got, want := w.Header().Get("Content-Type"), "image/png"; got != want {
+				t.Errorf("%s: want content type '%s', got '%s'", url, want, got)
+			}
+
+			continue
+		}
+
+		g, err := gif.DecodeAll(w.Body)
+		if err != nil {
+			t.Fatalf("%s: %v while decoding response body", url, err)
+		}
+
+		if got, want := len(g.Image), 1; got != want {
+			t.Errorf("%s: want %d frame, got %d", url, want, got)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	iccHeaderSize  = 128
+	iccTagSize     = 12
+	iccChunkHeader = 14 // "ICC_PROFILE\0", sequence number, chunk count
+	maxICCSize     = 1 << 20
+	// srgbLevels is the size of the linear to sRGB encoding table.
+	srgbLevels = 4096
+)
+
+var (
+	iccSignature = []byte("ICC_PROFILE\x00")
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	errBadICC = errors.New("malformed ICC profile")
+)
+
+// xyzToSRGB converts PCS (D50) XYZ to linear sRGB, Bradford-adapted.
+var xyzToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// srgbEncode maps linear light to 8-bit sRGB.
+var srgbEncode = func() [srgbLevels + 1]uint8 {
+	var t [srgbLevels + 1]uint8
+
+	for i := range t {
+		v := float64(i) / srgbLevels
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+
+		t[i] = uint8(math.Round(v * 255))
+	}
+
+	return t
+}()
+
+type iccProfile struct {
+	colorSpace string
+	pcs        string
+	tags       map[string][]byte
+}
+
+// jpegICC reassembles the ICC profile split over APP2 segments.
+func jpegICC(data []byte) []byte {
+	chunks := map[byte][]byte{}
+
+	jpegSegments(data, func(marker byte, segment []byte) bool {
+		if marker == 0xe2 && len(segment) > iccChunkHeader && bytes.HasPrefix(segment, iccSignature) {
+			chunks[segment[len(iccSignature)]] = segment[iccChunkHeader:]
+		}
+
+		return true
+	})
+
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, int(seq))
+	}
+	sort.Ints(seqs)
+
+	var profile []byte
+	for _, seq := range seqs {
+		profile = append(profile, chunks[byte(seq)]...)
+	}
+
+	return profile
+}
+
+// pngICC extracts the zlib compressed profile from the iCCP chunk of PNG data.
+func pngICC(data []byte) []byte {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+
+	for i := len(pngSignature); i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		if length < 0 || i+12+length > len(data) || kind == "IDAT" {
+			return nil
+		}
+
+		if kind == "iCCP" {
+			chunk := data[i+8 : i+8+length]
+			// profile name, NUL, compression method
+			name := bytes.IndexByte(chunk, 0)
+			if name < 0 || name+2 > len(chunk) {
+				return nil
+			}
+
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+			if err != nil {
+				return nil
+			}
+
+			profile, err := io.ReadAll(io.LimitReader(zr, maxICCSize))
+			if err != nil {
+				return nil
+			}
+
+			return profile
+		}
+
+		i += 12 + length
+	}
+
+	return nil
+}
+
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < iccHeaderSize+4 {
+		return nil, errBadICC
+	}
+
+	p := &iccProfile{
+		colorSpace: string(data[16:20]),
+		pcs:        string(data[20:24]),
+		tags:       map[string][]byte{},
+	}
+
+	count := int(binary.BigEndian.Uint32(data[iccHeaderSize:]))
+	for n := range count {
+		entry := iccHeaderSize + 4 + n*iccTagSize
+		if entry+iccTagSize > len(data) {
+			return nil, errBadICC
+		}
+
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, errBadICC
+		}
+
+		p.tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536 // #nosec G115
+}
+
+// xyzTag reads an XYZType tag.
+func (p *iccProfile) xyzTag(sig string) ([3]float64, bool) {
+	t := p.tags[sig]
+	if len(t) < 20 || string(t[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+
+	return [3]float64{s15Fixed16(t[8:]), s15Fixed16(t[12:]), s15Fixed16(t[16:])}, true
+}
+
+// curveTag reads a curveType or parametricCurveType tag into a function
+// mapping encoded values to linear light, both in [0, 1].
+func (p *iccProfile) curveTag(sig string) (func(float64) float64, bool) {
+	t := p.tags[sig]
+	if len(t) < 12 {
+		return nil, false
+	}
+
+	switch string(t[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if len(t) < 12+2*n {
+			return nil, false
+		}
+
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, true
+		case 1:
+			g := float64(binary.BigEndian.Uint16(t[12:])) / 256
+
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		default:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(t[12+2*i:])) / 0xffff
+			}
+
+			return func(x float64) float64 { return interpolate(table, x) }, true
+		}
+	case "para":
+		return parametricCurve(t)
+	}
+
+	return nil, false
+}
+
+func parametricCurve(t []byte) (func(float64) float64, bool) {
+	params := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}
+
+	kind := binary.BigEndian.Uint16(t[8:])
+	n, ok := params[kind]
+	if !ok || len(t) < 12+4*n {
+		return nil, false
+	}
+
+	var v [7]float64
+	for i := range n {
+		v[i] = s15Fixed16(t[12+4*i:])
+	}
+	g, a, b, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+
+	pow := func(x float64) float64 { return math.Pow(max(a*x+b, 0), g) }
+
+	switch kind {
+	case 0:
+		return func(x float64) float64 { return math.Pow(x, g) }, true
+	case 1:
+		return func(x float64) float64 {
+			if x >= -b/a {
+				return pow(x)
+			}
+
+			return 0
+		}, true
+	case 2:
+		return func(x float64) float64 {
+			if x >= -b/a {
+				return pow(x) + c
+			}
+
+			return c
+		}, true
+	case 3:
+		return func(x float64) float64 {
+			if x >= d {
+				return pow(x)
+			}
+
+			return c * x
+		}, true
+	default:
+		return func(x float64) float64 {
+			if x >= d {
+				return pow(x) + e
+			}
+
+			return c*x + f
+		}, true
+	}
+}
+
+// interpolate looks x in [0, 1] up in an evenly spaced table.
+func interpolate(table []float64, x float64) float64 {
+	if len(table) == 1 {
+		return table[0]
+	}
+
+	pos := min(max(x, 0), 1) * float64(len(table)-1)
+	i := min(int(pos), len(table)-2)
+
+	return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+}
+
+func encodeSRGB(v float64) uint8 {
+	return srgbEncode[int(min(max(v, 0), 1)*srgbLevels+0.5)]
+}
+
+// xyzToPixel converts PCS XYZ to an 8-bit sRGB pixel.
+func xyzToPixel(xyz [3]float64, a uint8) color.NRGBA {
+	var rgb [3]uint8
+
+	for i, row := range xyzToSRGB {
+		rgb[i] = encodeSRGB(row[0]*xyz[0] + row[1]*xyz[1] + row[2]*xyz[2])
+	}
+
+	return color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: a}
+}
+
+// rgbToSRGB builds a converter for matrix/TRC RGB profiles such as Adobe RGB.
+func (p *iccProfile) rgbToSRGB() (func(color.NRGBA) color.NRGBA, bool) {
+	if p.colorSpace != "RGB " || p.pcs != "XYZ " {
+		return nil, false
+	}
+
+	var (
+		matrix [3][3]float64
+		lin    [3][256]float64
+	)
+
+	for i, ch := range []string{"r", "g", "b"} {
+		xyz, ok := p.xyzTag(ch + "XYZ")
+		if !ok {
+			return nil, false
+		}
+
+		trc, ok := p.curveTag(ch + "TRC")
+		if !ok {
+			return nil, false
+		}
+
+		for j := range 3 {
+			matrix[j][i] = xyz[j]
+		}
+
+		for v := range lin[i] {
+			lin[i][v] = trc(float64(v) / 255)
+		}
+	}
+
+	return func(c color.NRGBA) color.NRGBA {
+		r, g, b := lin[0][c.R], lin[1][c.G], lin[2][c.B]
+
+		return xyzToPixel([3]float64{
+			matrix[0][0]*r + matrix[0][1]*g + matrix[0][2]*b,
+			matrix[1][0]*r + matrix[1][1]*g + matrix[1][2]*b,
+			matrix[2][0]*r + matrix[2][1]*g + matrix[2][2]*b,
+		}, c.A)
+	}, true
+}
+
+// lut is a lut8Type or lut16Type transform with values scaled to [0, 1].
+type lut struct {
+	in, out, grid int
+	inTables      [][]float64
+	clut          []float64
+	outTables     [][]float64
+	legacyLab     bool
+}
+
+func readTable(b []byte, n, width int) []float64 {
+	t := make([]float64, n)
+	for i := range t {
+		if width == 1 {
+			t[i] = float64(b[i]) / 0xff
+		} else {
+			t[i] = float64(binary.BigEndian.Uint16(b[2*i:])) / 0xffff
+		}
+	}
+
+	return t
+}
+
+func parseLut(t []byte) (*lut, bool) {
+	if len(t) < 48 {
+		return nil, false
+	}
+
+	// only CMYK to PCS transforms are converted
+	l := &lut{in: int(t[8]), out: int(t[9]), grid: int(t[10])}
+	if l.in != 4 || l.out != 3 || l.grid < 2 {
+		return nil, false
+	}
+
+	inEntries, outEntries, width, pos := 256, 256, 1, 48
+
+	switch string(t[:4]) {
+	case "mft1":
+	case "mft2":
+		if len(t) < 52 {
+			return nil, false
+		}
+		inEntries = int(binary.BigEndian.Uint16(t[48:]))
+		outEntries = int(binary.BigEndian.Uint16(t[50:]))
+		width, pos = 2, 52
+		l.legacyLab = true
+	default:
+		return nil, false
+	}
+
+	// tables are interpolated between two entries at least
+	if inEntries < 2 || outEntries < 2 || !l.readTables(t, pos, width, inEntries, outEntries) {
+		return nil, false
+	}
+
+	return l, true
+}
+
+// readTables reads the input tables, the CLUT and the output tables from t,
+// starting at pos. It fails if t is too short to hold them.
+func (l *lut) readTables(t []byte, pos, width, inEntries, outEntries int) bool {
+	points := 1
+	for range l.in {
+		// a CLUT with more points than the tag has bytes cannot fit, give
+		// up before the count overflows
+		if points *= l.grid; points > len(t) {
+			return false
+		}
+	}
+
+	if len(t) < pos+width*(l.in*inEntries+points*l.out+l.out*outEntries) {
+		return false
+	}
+
+	for range l.in {
+		l.inTables = append(l.inTables, readTable(t[pos:], inEntries, width))
+		pos += width * inEntries
+	}
+
+	l.clut = readTable(t[pos:], points*l.out, width)
+	pos += width * points * l.out
+
+	for range l.out {
+		l.outTables = append(l.outTables, readTable(t[pos:], outEntries, width))
+		pos += width * outEntries
+	}
+
+	return true
+}
+
+// eval runs input values in [0, 1] through the tables and the CLUT using
+// multilinear interpolation.
+func (l *lut) eval(input []float64) []float64 {
+	base := 0
+	stride := l.out
+	frac := make([]float64, l.in)
+	strides := make([]int, l.in)
+
+	for i := l.in - 1; i >= 0; i-- {
+		pos := interpolate(l.inTables[i], input[i]) * float64(l.grid-1)
+		idx := min(int(pos), l.grid-2)
+		frac[i] = pos - float64(idx)
+		strides[i] = stride
+		base += idx * stride
+		stride *= l.grid
+	}
+
+	out := make([]float64, l.out)
+	for corner := range 1 << l.in {
+		weight, offset := 1.0, base
+
+		for i := range l.in {
+			if corner&(1<<i) != 0 {
+				weight *= frac[i]
+				offset += strides[i]
+			} else {
+				weight *= 1 - frac[i]
+			}
+		}
+
+		if weight == 0 {
+			continue
+		}
+
+		for o := range out {
+			out[o] += weight * l.clut[offset+o]
+		}
+	}
+
+	for o := range out {
+		out[o] = interpolate(l.outTables[o], out[o])
+	}
+
+	return out
+}
+
+// labToXYZ converts PCS encoded Lab (D50) to XYZ.
+func labToXYZ(v []float64, legacy bool) [3]float64 {
+	scale := 1.0
+	if legacy {
+		// lut16Type uses the ICC v2 encoding where 0xff00 means L = 100
+		scale = 0xffff / float64(0xff00)
+	}
+
+	l, a, b := v[0]*scale*100, v[1]*scale*255-128, v[2]*scale*255-128
+
+	f := func(t float64) float64 {
+		if t > 6.0/29 {
+			return t * t * t
+		}
+
+		return 3 * (6.0 / 29) * (6.0 / 29) * (t - 4.0/29)
+	}
+
+	fy := (l + 16) / 116
+
+	return [3]float64{0.9642 * f(fy+a/500), f(fy), 0.8249 * f(fy-b/200)}
+}
+
+// cmykToSRGB builds a converter for LUT based CMYK profiles. Only lut8Type
+// and lut16Type transforms are supported, which covers ICC v2 press profiles.
+func (p *iccProfile) cmykToSRGB() (func(color.CMYK) color.NRGBA, bool) {
+	if p.colorSpace != "CMYK" {
+		return nil, false
+	}
+
+	t, ok := p.tags["A2B0"]
+	if !ok {
+		t = p.tags["A2B1"]
+	}
+
+	l, ok := parseLut(t)
+	if !ok {
+		return nil, false
+	}
+
+	pcsLab := p.pcs == "Lab "
+	in := make([]float64, 4)
+
+	return func(c color.CMYK) color.NRGBA {
+		in[0], in[1], in[2], in[3] = float64(c.C)/0xff, float64(c.M)/0xff, float64(c.Y)/0xff, float64(c.K)/0xff
+		v := l.eval(in)
+
+		if pcsLab {
+			return xyzToPixel(labToXYZ(v, l.legacyLab), 0xff)
+		}
+
+		// u1Fixed15 XYZ encoding
+		scale := 0xffff / float64(0x8000)
+
+		return xyzToPixel([3]float64{v[0] * scale, v[1] * scale, v[2] * scale}, 0xff)
+	}, true
+}
+
+// embeddedICC returns the ICC profile embedded in JPEG or PNG data.
+func embeddedICC(data []byte, format string) []byte {
+	switch format {
+	case formatJpeg:
+		return jpegICC(data)
+	case formatPng:
+		return pngICC(data)
+	}
+
+	return nil
+}
+
+// toSRGB converts img to sRGB so that resizing works on the right colours:
+// CMYK (and YCCK, which the JPEG decoder turns into CMYK) images go through
+// their embedded profile or the naive formula, RGB images with an embedded
+// matrix/TRC profile (Adobe RGB and alike) through that profile.
+func toSRGB(img image.Image, profile []byte) image.Image {
+	p, err := parseICC(profile)
+	if err != nil {
+		p = &iccProfile{}
+	}
+
+	if cmyk, ok := img.(*image.CMYK); ok {
+		b := cmyk.Bounds()
+		dst := image.NewNRGBA(b)
+
+		convert, ok := p.cmykToSRGB()
+		if !ok {
+			draw.Draw(dst, b, cmyk, b.Min, draw.Src)
+
+			return dst
+		}
+
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				dst.SetNRGBA(x, y, convert(cmyk.CMYKAt(x, y)))
+			}
+		}
+
+		return dst
+	}
+
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return img
+	}
+
+	convert, ok := p.rgbToSRGB()
+	if !ok {
+		return img
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := dst.PixOffset(x, y)
+			c := convert(color.NRGBA{R: dst.Pix[i], G: dst.Pix[i+1], B: dst.Pix[i+2], A: dst.Pix[i+3]})
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = c.R, c.G, c.B
+		}
+	}
+
+	return dst
+}
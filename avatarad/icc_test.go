@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("%v while reading fixture", err)
+	}
+
+	return data
+}
+
+// closeColor compares opaque colours channel by channel.
+func closeColor(a, b color.Color, tolerance int) bool {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	diff := func(x, y uint32) bool {
+		d := int(x>>8) - int(y>>8)
+
+		return d <= tolerance && -d <= tolerance
+	}
+
+	return diff(ar, br) && diff(ag, bg) && diff(ab, bb)
+}
+
+func TestAdobeRGB(t *testing.T) {
+	parseTestConfig(t)
+
+	// reference values converted with the Adobe RGB (1998) and sRGB matrices
+	gray, red := color.NRGBA{R: 129, G: 129, B: 129, A: 255}, color.NRGBA{R: 231, G: 57, B: 34, A: 255}
+
+	for _, name := range []string{"adobergb.jpeg", "adobergb.png"} {
+		data := readFixture(t, name)
+
+		if len(embeddedICC(data, name[len("adobergb."):])) == 0 {
+			t.Errorf("%s: embedded profile not found", name)
+		}
+
+		img, _, err := decodeImage(data)
+		if err != nil {
+			t.Fatalf("%s: %v while decoding fixture", name, err)
+		}
+
+		if c := img.At(4, 8); !closeColor(c, gray, 2) {
+			t.Errorf("%s: want gray %v, got %v", name, gray, c)
+		}
+
+		if c := img.At(28, 8); !closeColor(c, red, 3) {
+			t.Errorf("%s: want red %v, got %v", name, red, c)
+		}
+	}
+}
+
+func TestCMYK(t *testing.T) {
+	parseTestConfig(t)
+
+	data := readFixture(t, "cmyk.jpeg")
+
+	raw, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%v while decoding fixture", err)
+	}
+
+	img, _, err := decodeImage(data)
+	if err != nil {
+		t.Fatalf("%v while decoding fixture", err)
+	}
+
+	if _, ok := img.(*image.CMYK); ok {
+		t.Fatalf("Want image converted from CMYK")
+	}
+
+	for _, p := range []image.Point{{0, 0}, {75, 50}, {149, 102}} {
+		if got, want := img.At(p.X, p.Y), raw.At(p.X, p.Y); !closeColor(got, want, 0) {
+			t.Errorf("%v: want %v, got %v", p, want, got)
+		}
+	}
+}
+
+func TestCMYKProfile(t *testing.T) {
+	parseTestConfig(t)
+
+	data := readFixture(t, "cmyk-lab.jpeg")
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%v while decoding fixture", err)
+	}
+
+	raw, ok := decoded.(*image.CMYK)
+	if !ok {
+		t.Fatalf("Want CMYK fixture, got %T", decoded)
+	}
+
+	img, _, err := decodeImage(data)
+	if err != nil {
+		t.Fatalf("%v while decoding fixture", err)
+	}
+
+	// the fixture profile maps K linearly to L* and ignores C, M and Y
+	for _, p := range []image.Point{{0, 0}, {75, 50}, {30, 90}, {149, 102}} {
+		k := float64(raw.CMYKAt(p.X, p.Y).K) / 0xff
+		y := math.Pow((100*(1-k)+16)/116, 3)
+		if y <= 0.008856 {
+			y = 100 * (1 - k) / 903.3
+		}
+		v := encodeSRGB(y)
+		want := color.NRGBA{R: v, G: v, B: v, A: 255}
+
+		if got := img.At(p.X, p.Y); !closeColor(got, want, 2) {
+			t.Errorf("%v: want %v, got %v", p, want, got)
+		}
+	}
+}
+
+func TestBrokenICC(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+
+	for _, p := range [][]byte{nil, []byte("short"), make([]byte, 200)} {
+		if got := toSRGB(img, p); got != image.Image(img) {
+			t.Errorf("Want image untouched for broken profile")
+		}
+	}
+}
+
+// cmykProfile wraps an A2B0 tag in a CMYK to Lab profile.
+func cmykProfile(tag []byte) []byte {
+	p := make([]byte, iccHeaderSize+4+iccTagSize)
+	copy(p[16:], "CMYKLab ")
+	binary.BigEndian.PutUint32(p[iccHeaderSize:], 1)
+	copy(p[iccHeaderSize+4:], "A2B0")
+	binary.BigEndian.PutUint32(p[iccHeaderSize+8:], uint32(len(p)))
+	binary.BigEndian.PutUint32(p[iccHeaderSize+12:], uint32(len(tag))) // #nosec G115
+
+	return append(p, tag...)
+}
+
+// lutTag builds a lut8Type or lut16Type tag header padded to size bytes.
+func lutTag(sig string, in, out, grid byte, entries uint16, size int) []byte {
+	t := make([]byte, size)
+	copy(t, sig)
+	t[8], t[9], t[10] = in, out, grid
+	binary.BigEndian.PutUint16(t[48:], entries)
+	binary.BigEndian.PutUint16(t[50:], entries)
+
+	return t
+}
+
+func TestBrokenLut(t *testing.T) {
+	// 4 input and 3 output tables of 2 entries and a CLUT of 2⁴ points
+	valid := lutTag("mft2", 4, 3, 2, 2, 52+2*(4*2+16*3+3*2))
+
+	tests := map[string][]byte{
+		"truncated":            valid[:100],
+		"short header":         valid[:40],
+		"8 inputs":             lutTag("mft1", 8, 3, 235, 0, 4096),
+		"overflowing grid":     lutTag("mft1", 4, 3, 255, 0, 4096),
+		"no table entries":     lutTag("mft2", 4, 3, 2, 0, 4096),
+		"single table entry":   lutTag("mft2", 4, 3, 2, 1, 4096),
+		"RGB transform":        lutTag("mft2", 3, 3, 2, 2, 4096),
+		"single point grid":    lutTag("mft2", 4, 3, 1, 2, 4096),
+		"unsupported tag type": lutTag("mAB ", 4, 3, 2, 2, 4096),
+	}
+
+	img := image.NewCMYK(image.Rect(0, 0, 2, 2))
+
+	for name, tag := range tests {
+		p, err := parseICC(cmykProfile(tag))
+		if err != nil {
+			t.Fatalf("%s: %v while parsing profile", name, err)
+		}
+
+		if _, ok := p.cmykToSRGB(); ok {
+			t.Errorf("%s: want LUT rejected", name)
+		}
+
+		// falls back to the naive conversion
+		if got := toSRGB(img, cmykProfile(tag)); got.Bounds() != img.Bounds() {
+			t.Errorf("%s: want image converted, got %v", name, got.Bounds())
+		}
+	}
+
+	p, err := parseICC(cmykProfile(valid))
+	if err != nil {
+		t.Fatalf("%v while parsing profile", err)
+	}
+
+	if _, ok := p.cmykToSRGB(); !ok {
+		t.Error("Want LUT accepted")
+	}
+}
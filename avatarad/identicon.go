@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// identicons are a mirrored identiconCells×identiconCells grid with a
+	// margin of half a cell, drawn on a grid of identiconUnits units
+	identiconCells = 5
+	identiconUnits = 12
+
+	cspHeader        = "Content-Security-Policy"
+	cspValue         = "default-src 'none'; sandbox"
+	nosniffHeader    = "X-Content-Type-Options"
+	nosniffValue     = "nosniff"
+	identiconBgColor = 0xf0
+)
+
+// identicon is the vector model of a generated avatar: the cells set in the
+// grid and the colors. It is rasterized or written as SVG at the requested
+// size, so it stays sharp at any size.
+type identicon struct {
+	cells [identiconCells][identiconCells]bool
+	fg    color.NRGBA
+	bg    color.NRGBA
+}
+
+// newIdenticon derives an identicon from a hash: the same hash always gives
+// the same picture, whatever its length or case.
+func newIdenticon(hash string) identicon {
+	sum := sha256.Sum256([]byte(strings.ToLower(hash)))
+	ic := identicon{bg: color.NRGBA{identiconBgColor, identiconBgColor, identiconBgColor, 0xff}}
+
+	// the left half and middle column come from the hash, the right half
+	// mirrors them
+	for x := range (identiconCells + 1) / 2 {
+		for y := range identiconCells {
+			bit := x*identiconCells + y
+			on := sum[bit/8]>>(bit%8)&1 == 1
+			ic.cells[y][x] = on
+			ic.cells[y][identiconCells-1-x] = on
+		}
+	}
+
+	hue := float64(uint16(sum[30])<<8|uint16(sum[31])) / math.MaxUint16 * 360
+	ic.fg = hslColor(hue, 0.55+float64(sum[29]%20)/100, 0.45+float64(sum[28]%15)/100)
+
+	return ic
+}
+
+// hslColor converts a hue (degrees), saturation and lightness to RGB.
+func hslColor(h, s, l float64) color.NRGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+
+	channel := func(v float64) uint8 {
+		return uint8(math.Round((v + m) * 0xff))
+	}
+
+	return color.NRGBA{channel(r), channel(g), channel(b), 0xff}
+}
+
+// image rasterizes the identicon to a size×size image, cell edges are
+// snapped to whole pixels so the result is crisp.
+func (ic identicon) image(size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(dst, dst.Rect, image.NewUniform(ic.bg), image.Point{}, draw.Src)
+
+	edge := func(unit int) int {
+		return int(math.Round(float64(unit*size) / identiconUnits))
+	}
+
+	fg := image.NewUniform(ic.fg)
+	for y, row := range ic.cells {
+		for x, on := range row {
+			if on {
+				r := image.Rect(edge(1+2*x), edge(1+2*y), edge(3+2*x), edge(3+2*y))
+				draw.Draw(dst, r, fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	return dst
+}
+
+func svgColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// svg writes the identicon as an SVG document of the given size and shape.
+// Nothing but numbers and colors computed here goes into the document: no
+// scripts, styles, links or text, so there is nothing to sanitize.
+func (ic identicon) svg(size uint64, shape string) []byte {
+	buf := new(bytes.Buffer)
+	s := strconv.FormatUint(size, 10)
+
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="0 0 %d %d"`+
+		` shape-rendering="crispEdges">`, s, s, identiconUnits, identiconUnits)
+
+	if shape != shapeSquare {
+		radius := float64(identiconUnits) / 2
+		if shape == shapeRounded {
+			radius = cfg.CornerRadius * identiconUnits
+		}
+
+		fmt.Fprintf(buf, `<clipPath id="shape"><rect width="%d" height="%d" rx="%s"/></clipPath><g clip-path="url(#shape)">`,
+			identiconUnits, identiconUnits, strconv.FormatFloat(radius, 'f', -1, 64))
+	}
+
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="%s"/><path fill="%s" d="`,
+		identiconUnits, identiconUnits, svgColor(ic.bg), svgColor(ic.fg))
+
+	for y, row := range ic.cells {
+		for x, on := range row {
+			if on {
+				fmt.Fprintf(buf, "M%d %dh2v2h-2z", 1+2*x, 1+2*y)
+			}
+		}
+	}
+
+	buf.WriteString(`"/>`)
+
+	if shape != shapeSquare {
+		buf.WriteString("</g>")
+	}
+
+	buf.WriteString("</svg>")
+
+	return buf.Bytes()
+}
+
+// svgFormat reports whether a generated avatar is served as SVG: when the
+// .svg extension is used or, without an extension, the client accepts SVG.
+func svgFormat(r *http.Request, format string) bool {
+	return format == formatSvg || (len(format) == 0 && acceptsMime(r.Header.Get(acceptHeader), "image/"+formatSvg))
+}
+
+// serveIdenticon writes the identicon for hash: as SVG of the CSS size if
+// negotiated, otherwise rasterized to the device size (PNG unless another
+// format is asked for).
+func serveIdenticon(w http.ResponseWriter, r *http.Request, req avatarRequest) {
+	ic := newIdenticon(req.hash)
+
+	if svgFormat(r, req.format) {
+		w.Header().Set(cspHeader, cspValue)
+		w.Header().Set(nosniffHeader, nosniffValue)
+		writeAvatar(w, ic.svg(req.cssSize, req.shape), formatSvg,
+			image.Pt(int(req.cssSize), int(req.cssSize))) // #nosec G115
+
+		return
+	}
+
+	format := outputFormat(r, req.format, formatPng)
+
+	// the picture is drawn at the exact size, there is nothing to sharpen
+	img := finishImage(ic.image(int(req.size)), renderOptions{}, req.shape, req.bg, format) // #nosec G115
+
+	data, err := encodeAvatar(img, format, renderOptionsFor(req.size))
+	panicIf(err, "while encoding identicon")
+
+	writeAvatar(w, data, format, img.Bounds().Size())
+}
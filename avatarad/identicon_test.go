@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewIdenticon(t *testing.T) {
+	a := newIdenticon("0123456789abcdef0123456789abcdef")
+
+	if a != newIdenticon("0123456789ABCDEF0123456789ABCDEF") {
+		t.Error("Want identicons independent of the hash case")
+	}
+
+	if a == newIdenticon("fedcba9876543210fedcba9876543210") {
+		t.Error("Want different identicons for different hashes")
+	}
+
+	for y, row := range a.cells {
+		for x := range row {
+			if row[x] != row[identiconCells-1-x] {
+				t.Errorf("Want mirrored cells, row %d differs at %d", y, x)
+			}
+		}
+	}
+
+	if got := a.image(48).Bounds().Size(); got != image.Pt(48, 48) {
+		t.Errorf("Want 48×48 raster, got %v", got)
+	}
+}
+
+func TestIdenticonSVG(t *testing.T) {
+	parseTestConfig(t)
+
+	for _, shape := range []string{shapeSquare, shapeCircle, shapeRounded} {
+		data := newIdenticon("0123456789abcdef0123456789abcdef").svg(40, shape)
+
+		dec := xml.NewDecoder(bytes.NewReader(data))
+		root := ""
+
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				t.Fatalf("%s: %v while parsing SVG", shape, err)
+			}
+
+			if el, ok := tok.(xml.StartElement); ok {
+				if len(root) == 0 {
+					root = el.Name.Local
+				}
+
+				switch el.Name.Local {
+				case "svg", "rect", "path", "g", "clipPath":
+				default:
+					t.Errorf("%s: unexpected element %s", shape, el.Name.Local)
+				}
+			}
+		}
+
+		if root != "svg" || !bytes.Contains(data, []byte(`width="40" height="40"`)) {
+			t.Errorf("%s: want 40×40 svg document, got %s", shape, data)
+		}
+
+		if got := bytes.Contains(data, []byte("clip-path")); got != (shape != shapeSquare) {
+			t.Errorf("%s: want clip path %t, got %t", shape, shape != shapeSquare, got)
+		}
+	}
+}
+
+func TestHandleAvatarIdenticon(t *testing.T) {
+	const m, p string = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "cccccccccccccccccccccccccccccccc"
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{
+		m: {Image: defaultAvatar, LastUpdate: time.Now(), Source: sourceDefault},
+		p: {Image: testJpeg(t, 60, 60), LastUpdate: time.Now()},
+	}
+
+	tests := []struct {
+		path     string
+		accept   string
+		dpr      string
+		typ      string
+		size     int
+		byConfig bool
+	}{
+		{m + "?s=40&d=identicon", "image/svg+xml,image/*", "", "image/svg+xml", 40, false},
+		{m + ".svg?s=40&d=identicon", "", "2", "image/svg+xml", 40, false},
+		{m + "?s=40&d=identicon", "", "", "image/png", 40, false},
+		{m + "?s=40&d=identicon", "", "2", "image/png", 80, false},
+		{m + ".jpg?s=40&d=identicon", "image/svg+xml", "", "image/jpeg", 40, false},
+		{p + ".svg?s=40&d=identicon", "image/svg+xml", "", "image/jpeg", 40, false},
+		{m + "?s=40", "", "", "image/png", 40, true},
+	}
+
+	for _, tt := range tests {
+		cfg.DefaultAvatar = defaultImage
+		if tt.byConfig {
+			cfg.DefaultAvatar = generateIdenticon
+		}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/avatar/"+tt.path, nil)
+		if len(tt.accept) > 0 {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if len(tt.dpr) > 0 {
+			r.Header.Set("Sec-CH-DPR", tt.dpr)
+		}
+
+		avatarHandler(w, r)
+
+		if got := w.Header().Get("Content-Type"); got != tt.typ {
+			t.Errorf("%s: want content type '%s', got '%s'", tt.path, tt.typ, got)
+
+			continue
+		}
+
+		if tt.typ == "image/svg+xml" {
+			if got := w.Header().Get("Content-Security-Policy"); !strings.Contains(got, "default-src 'none'") {
+				t.Errorf("%s: want restrictive CSP, got '%s'", tt.path, got)
+			}
+
+			if !strings.Contains(w.Body.String(), `width="40"`) {
+				t.Errorf("%s: want SVG of the CSS size, got %s", tt.path, w.Body.String())
+			}
+
+			continue
+		}
+
+		ic, _, err := image.DecodeConfig(w.Body)
+		if err != nil || ic.Width != tt.size {
+			t.Errorf("%s: want %d pixels wide image, got %d (%v)", tt.path, tt.size, ic.Width, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const (
+	formatSource    = "source"
+	renderQueueSize = 1024
+)
+
+// rung is one pre-rendered size of a ladder: its dimensions and encodings
+// by format. Only encoded bytes are kept, a ladder is held for every photo.
+type rung struct {
+	dims    image.Point
+	encoded map[string][]byte
+}
+
+// ladder holds the pre-rendered sizes of one avatar, keyed by the size
+// after the upscale policy was applied. Ladders are never modified once
+// stored, so they are shared between hashes and requests without locking.
+type ladder struct {
+	source time.Time
+	format string
+	bg     color.Color
+	bounds image.Rectangle
+	rungs  map[uint64]*rung
+	sizes  []uint64
+	// base is the largest rung before sharpening and masking, encoded;
+	// other sizes and formats are derived from it
+	base []byte
+}
+
+type renderJob struct {
+	av     avatar
+	hashes []string
+}
+
+var (
+	ladders     = make(map[string]*ladder)
+	renderQueue chan renderJob
+	errNoRung   = errors.New("no pre-rendered variant large enough")
+)
+
+func checkPrerenderConfig() error {
+	for _, f := range cfg.LadderFormats {
+		if _, ok := extFormats[f]; (!ok || len(f) == 0) && f != formatSource {
+			return errors.New("unsupported pre-render format " + f)
+		}
+	}
+
+	for _, s := range cfg.LadderSizes {
+		if s == 0 {
+			return errors.New("PRERENDER_SIZES must be positive")
+		}
+	}
+
+	if cfg.LadderWorkers < 0 {
+		return errors.New("PRERENDER_WORKERS must not be negative")
+	}
+
+	return nil
+}
+
+func ladderGet(h string) *ladder {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return ladders[h]
+}
+
+func ladderWrite(l *ladder, hashes ...string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, h := range hashes {
+		ladders[h] = l
+	}
+}
+
+// renderLadder renders the configured sizes and formats of av with the
+// default fit mode, background and shape. Animations are not pre-rendered.
+func renderLadder(av avatar) (*ladder, error) {
+	img, format, err := decodeImage(av.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == formatGif && gifFrames(av.Image) > 1 {
+		return nil, errors.New("animations are not pre-rendered")
+	}
+
+	if len(av.Format) > 0 {
+		format = av.Format
+	}
+
+	bg, err := parseColor(cfg.BackgroundColor)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &ladder{
+		source: av.LastUpdate,
+		format: format,
+		bg:     bg,
+		bounds: img.Bounds(),
+		rungs:  make(map[uint64]*rung),
+	}
+
+	for _, s := range cfg.LadderSizes {
+		size := limitUpscale(clampSize(s), l.bounds, cfg.FitMode, av.Crop)
+		if _, ok := l.rungs[size]; ok {
+			continue
+		}
+
+		if err := l.addRung(img, size, av.Crop); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(l.sizes, func(i, j int) bool { return l.sizes[i] < l.sizes[j] })
+
+	if err := l.encodeBase(img, av.Crop); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// addRung fits img to size, encodes it in the pre-render formats and adds it
+// to the ladder.
+func (l *ladder) addRung(img image.Image, size uint64, crop image.Rectangle) error {
+	opts := renderOptionsFor(size)
+	fitted := fitImage(img, uint(size), cfg.FitMode, l.bg, crop, opts.filter)
+
+	r := &rung{dims: fitted.Bounds().Size(), encoded: make(map[string][]byte)}
+	for _, f := range cfg.LadderFormats {
+		if f == formatSource {
+			f = shapeFormat(l.format, cfg.Shape)
+		}
+
+		var err error
+		if r.encoded[f], err = encodeAvatar(finishImage(fitted, opts, cfg.Shape, l.bg, f), f, opts); err != nil {
+			return err
+		}
+	}
+
+	l.rungs[size] = r
+	l.sizes = append(l.sizes, size)
+
+	return nil
+}
+
+// encodeBase fits img to the largest rung and keeps it encoded as the base
+// other sizes and formats are derived from. JPEG photos stay JPEG, anything
+// else is kept lossless.
+func (l *ladder) encodeBase(img image.Image, crop image.Rectangle) error {
+	if len(l.sizes) == 0 {
+		return nil
+	}
+
+	size := l.sizes[len(l.sizes)-1]
+	opts := renderOptionsFor(size)
+
+	format := formatPng
+	if l.format == formatJpeg {
+		format = formatJpeg
+	}
+
+	var err error
+	l.base, err = encodeAvatar(fitImage(img, uint(size), cfg.FitMode, l.bg, crop, opts.filter), format, opts)
+
+	return err
+}
+
+// render returns the avatar of the given size in format: pre-rendered
+// encodings are served as they are, other sizes and formats are derived from
+// the largest rung.
+func (l *ladder) render(size uint64, format string) ([]byte, image.Point, error) {
+	if r, ok := l.rungs[size]; ok {
+		if data, ok := r.encoded[format]; ok {
+			return data, r.dims, nil
+		}
+	}
+
+	if len(l.sizes) == 0 || size > l.sizes[len(l.sizes)-1] {
+		return nil, image.Point{}, errNoRung
+	}
+
+	img, _, err := decodeImage(l.base)
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+
+	// rungs are fitted already, so scaling keeps the framing; the longer
+	// side determines the size for non-square rungs
+	opts := renderOptionsFor(size)
+	if size != l.sizes[len(l.sizes)-1] {
+		if b := img.Bounds(); b.Dx() >= b.Dy() {
+			img = scaleImage(img, uint(size), 0, opts.filter)
+		} else {
+			img = scaleImage(img, 0, uint(size), opts.filter)
+		}
+	}
+
+	data, err := encodeAvatar(finishImage(img, opts, cfg.Shape, l.bg, format), format, opts)
+
+	return data, img.Bounds().Size(), err
+}
+
+// startRenderers starts the pre-render worker pool; a zero number of workers
+// means one per CPU.
+func startRenderers(workers int) {
+	if !cfg.LadderEnabled || len(cfg.LadderSizes) == 0 || len(cfg.LadderFormats) == 0 {
+		return
+	}
+
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	renderQueue = make(chan renderJob, renderQueueSize)
+	for range workers {
+		go func() {
+			for job := range renderQueue {
+				l, err := renderLadder(job.av)
+				expectVariants(job.av, false)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, job.hashes[0]+" × prerender: "+err.Error())
+
+					continue
+				}
+
+				ladderWrite(l, job.hashes...)
+				shareLadder(job.av, l)
+				fmt.Fprintln(os.Stderr, job.hashes[0]+" → prerendered")
+			}
+		}()
+	}
+}
+
+// queueRender schedules pre-rendering of av for hashes. Ingest never waits
+// for the workers: when the queue is full the avatar is rendered on request.
+func queueRender(av avatar, hashes ...string) {
+	if renderQueue == nil {
+		return
+	}
+
+	expectVariants(av, true)
+
+	select {
+	case renderQueue <- renderJob{av, hashes}:
+	default:
+		expectVariants(av, false)
+		fmt.Fprintln(os.Stderr, hashes[0]+" × prerender queue full")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRenderLadder(t *testing.T) {
+	t.Setenv("PRERENDER_SIZES", "24,48,256,80")
+	t.Setenv("PRERENDER_FORMATS", "source,webp")
+	t.Setenv("UPSCALE_POLICY", "original")
+	parseTestConfig(t)
+
+	av, err := newAvatar(testJpeg(t, 120, 160))
+	if err != nil {
+		t.Fatalf("%v while ingesting avatar", err)
+	}
+
+	l, err := renderLadder(av)
+	if err != nil {
+		t.Fatalf("%v while rendering ladder", err)
+	}
+
+	// 256 is capped to the 120 pixels crop box by the upscale policy
+	if got, want := l.sizes, []uint64{24, 48, 80, 120}; !slices.Equal(got, want) {
+		t.Fatalf("Want rungs %v, got %v", want, got)
+	}
+
+	for size, r := range l.rungs {
+		if got := r.dims; got != image.Pt(int(size), int(size)) {
+			t.Errorf("Want %d×%d rung, got %v", size, size, got)
+		}
+
+		if _, format, err := image.DecodeConfig(bytes.NewReader(r.encoded[formatJpeg])); err != nil || format != formatJpeg {
+			t.Errorf("Want JPEG encoding of rung %d, got %s (%v)", size, format, err)
+		}
+
+		if b := r.encoded[formatWebp]; len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+			t.Errorf("Want WebP encoding of rung %d", size)
+		}
+	}
+
+	if _, err := renderLadder(avatar{Image: testAnimation(t)}); err == nil {
+		t.Error("Want animations to be left to the request path")
+	}
+}
+
+func TestRenderLadderBase(t *testing.T) {
+	t.Setenv("PRERENDER_SIZES", "24,80,48")
+	t.Setenv("PRERENDER_FORMATS", "webp")
+	parseTestConfig(t)
+
+	av, err := newAvatar(testJpeg(t, 120, 160))
+	if err != nil {
+		t.Fatalf("%v while ingesting avatar", err)
+	}
+
+	l, err := renderLadder(av)
+	if err != nil {
+		t.Fatalf("%v while rendering ladder", err)
+	}
+
+	ic, format, err := image.DecodeConfig(bytes.NewReader(l.base))
+	if err != nil || format != formatJpeg || image.Pt(ic.Width, ic.Height) != image.Pt(80, 80) {
+		t.Errorf("Want 80×80 JPEG base, got %s %d×%d (%v)", format, ic.Width, ic.Height, err)
+	}
+
+	// formats and sizes that were not pre-rendered are derived from it
+	data, dims, err := l.render(48, formatJpeg)
+	if err != nil || dims != image.Pt(48, 48) {
+		t.Fatalf("Want 48×48 image, got %v (%v)", dims, err)
+	}
+
+	if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || format != formatJpeg {
+		t.Errorf("Want JPEG, got %s (%v)", format, err)
+	}
+}
+
+func TestHandleAvatarLadder(t *testing.T) {
+	const m string = "66666666666666666666666666666666"
+
+	t.Setenv("PRERENDER_SIZES", "24,48,80")
+	t.Setenv("PRERENDER_FORMATS", "jpeg")
+	parseTestConfig(t)
+
+	av, err := newAvatar(testJpeg(t, 120, 160))
+	if err != nil {
+		t.Fatalf("%v while ingesting avatar", err)
+	}
+
+	l, err := renderLadder(av)
+	if err != nil {
+		t.Fatalf("%v while rendering ladder", err)
+	}
+
+	// a marker proves the pre-rendered bytes are served without rendering
+	marker := []byte("pre-rendered")
+	l.rungs[48].encoded[formatJpeg] = marker
+
+	hs = map[string]avatar{m: av}
+	ladders = map[string]*ladder{m: l}
+
+	tests := []struct {
+		query  string
+		marker bool
+		size   int
+	}{
+		{"?s=48", true, 48},
+		{"?s=40", false, 40},
+		{"?s=48&fit=pad", false, 48},
+		{"?s=48&bg=000000", false, 48},
+		{"?s=100", false, 100},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		avatarHandler(w, httptest.NewRequest("GET", "/avatar/"+m+tt.query, nil))
+
+		if got := bytes.Equal(w.Body.Bytes(), marker); got != tt.marker {
+			t.Errorf("%s: want pre-rendered bytes %t, got %t", tt.query, tt.marker, got)
+		}
+
+		if tt.marker {
+			continue
+		}
+
+		ic, _, err := image.DecodeConfig(w.Body)
+		if err != nil || ic.Width != tt.size || ic.Height != tt.size {
+			t.Errorf("%s: want %d×%d image, got %d×%d (%v)", tt.query, tt.size, tt.size, ic.Width, ic.Height, err)
+		}
+	}
+
+	// a ladder rendered from an older image is ignored
+	av.LastUpdate = av.LastUpdate.Add(time.Second)
+	hsWrite(m, av)
+
+	w := httptest.NewRecorder()
+	avatarHandler(w, httptest.NewRequest("GET", "/avatar/"+m+"?s=48", nil))
+
+	if bytes.Equal(w.Body.Bytes(), marker) {
+		t.Error("Want stale ladder to be ignored")
+	}
+}
+
+func TestRenderQueue(t *testing.T) {
+	const (
+		m = "77777777777777777777777777777777"
+		s = "8888888888888888888888888888888888888888888888888888888888888888"
+	)
+
+	t.Setenv("PRERENDER_SIZES", "32")
+	parseTestConfig(t)
+
+	startRenderers(1)
+	t.Cleanup(func() {
+		close(renderQueue)
+		renderQueue = nil
+	})
+
+	av, err := newAvatar(testJpeg(t, 64, 64))
+	if err != nil {
+		t.Fatalf("%v while ingesting avatar", err)
+	}
+
+	queueRender(av, m, s)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ladderGet(m) != nil && ladderGet(s) != nil {
+			return
+		}
+	}
+
+	t.Error("Want both hashes pre-rendered")
+}
+
+func TestRenderQueueChain(t *testing.T) {
+	const m, n string = "78787878787878787878787878787878", "89898989898989898989898989898989"
+
+	t.Setenv("SOURCES", "gravatar")
+	t.Setenv("GRAVATAR_ENABLED", "true")
+	parseTestConfig(t)
+
+	renderQueue = make(chan renderJob, 1)
+	t.Cleanup(func() { renderQueue = nil })
+
+	photo, err := newAvatar(testJpeg(t, 64, 64))
+	if err != nil {
+		t.Fatalf("%v while ingesting avatar", err)
+	}
+	photo.Source = sourceGravatar
+
+	grav := &fakeSource{source: sourceGravatar, av: photo}
+	withSources(t, grav)
+
+	hs = map[string]avatar{}
+	ladders = map[string]*ladder{}
+
+	getAvatar(m, "")
+
+	select {
+	case job := <-renderQueue:
+		if !slices.Equal(job.hashes, []string{m}) {
+			t.Errorf("Want %s queued, got %v", m, job.hashes)
+		}
+	default:
+		t.Error("Want a photo found through the chain queued for pre-rendering")
+	}
+
+	// negative entries are not pre-rendered
+	grav.av, grav.err = avatar{}, errNotFound
+	getAvatar(n, "")
+
+	if len(renderQueue) > 0 {
+		t.Error("Want no default avatar queued for pre-rendering")
+	}
+}
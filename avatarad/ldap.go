@@ -1,12 +1,13 @@
 package main
 
 import (
-	"crypto/md5" // #nosec G501
-	"crypto/sha256"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/go-ldap/ldap/v3"
@@ -16,6 +17,14 @@ var (
 	certsInit = false
 	rootCA    *x509.CertPool
 	tlsConfig tls.Config
+
+	// ldapRead is when LDAP was last read; a lookup missing the cache
+	// reads it again only after LDAP_REFRESH_INTERVAL.
+	ldapRead   time.Time
+	ldapReadMu sync.Mutex
+	// ldapReading is held while LDAP is read, so concurrent lookups wait
+	// for one read instead of each starting their own.
+	ldapReading = make(chan struct{}, 1)
 )
 
 func prepareCerts() {
@@ -45,12 +54,30 @@ func prepareCerts() {
 	}
 }
 
-func getEntries() []*ldap.Entry {
+func ldapAttributes() []string {
+	attrs := []string{cfg.LdapEmailAttr, cfg.LdapAvatarAttr, cfg.LdapUIDAttr}
+	for _, attr := range []string{cfg.LdapOpenIDAttr, cfg.LdapURLAttr} {
+		if len(attr) > 0 {
+			attrs = append(attrs, attr)
+		}
+	}
+
+	return attrs
+}
+
+// getEntries reads the users from LDAP, within the deadline of ctx if it has
+// one.
+func getEntries(ctx context.Context) []*ldap.Entry {
 	var (
 		l   *ldap.Conn
 		err error
 	)
 
+	dialer := &net.Dialer{Timeout: defaultTimeout * time.Second}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
 	if !certsInit {
 		prepareCerts()
 		certsInit = true
@@ -59,11 +86,14 @@ func getEntries() []*ldap.Entry {
 	ldapServPort := fmt.Sprintf("%s:%d", cfg.LdapServerFQDN, cfg.LdapPort)
 
 	if cfg.LdapSSL {
-		l, err = ldap.DialURL("ldaps://"+ldapServPort, ldap.DialWithTLSConfig(&tlsConfig))
+		l, err = ldap.DialURL("ldaps://"+ldapServPort, ldap.DialWithTLSConfig(&tlsConfig), ldap.DialWithDialer(dialer))
 	} else {
-		l, err = ldap.DialURL("ldap://" + ldapServPort)
+		l, err = ldap.DialURL("ldap://"+ldapServPort, ldap.DialWithDialer(dialer))
 	}
 	panicIf(err, "while connecting to LDAP server "+ldapServPort)
+	if deadline, ok := ctx.Deadline(); ok {
+		l.SetTimeout(time.Until(deadline))
+	}
 	defer func() {
 		err = l.Close()
 		panicIf(err, "while closing connection to LDAP server "+ldapServPort)
@@ -79,7 +109,7 @@ func getEntries() []*ldap.Entry {
 
 	searchRequest := ldap.NewSearchRequest(cfg.LdapUserBase,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		cfg.LdapUserFilter, []string{cfg.LdapEmailAttr, cfg.LdapAvatarAttr}, nil)
+		cfg.LdapUserFilter, ldapAttributes(), nil)
 
 	sr, err := l.Search(searchRequest)
 	panicIf(err, "while searching LDAP database")
@@ -88,39 +118,175 @@ func getEntries() []*ldap.Entry {
 }
 
 func fillHash() {
-	for _, entry := range getEntries() {
-		mail := entry.GetAttributeValue(cfg.LdapEmailAttr)
-		if len(mail) == 0 {
+	fillHashContext(context.Background())
+}
+
+// fillHashContext caches the photos of all LDAP users, within the deadline of
+// ctx if it has one.
+func fillHashContext(ctx context.Context) {
+	ldapReadMu.Lock()
+	ldapRead = time.Now()
+	ldapReadMu.Unlock()
+
+	for _, entry := range getEntries(ctx) {
+		var hashes []string
+
+		// users without a photo may have one on the Libravatar server of
+		// their domain
+		if mail := normalizeEmail(entry.GetAttributeValue(cfg.LdapEmailAttr)); len(mail) > 0 {
+			hashes = emailHashes(mail)
+			for _, hash := range hashes {
+				emailWrite(hash, mail)
+			}
+		}
+
+		if len(cfg.LdapOpenIDAttr) > 0 {
+			for _, uri := range entry.GetAttributeValues(cfg.LdapOpenIDAttr) {
+				if hash := openidHash(uri); len(hash) > 0 {
+					hashes = append(hashes, hash)
+				}
+			}
+		}
+
+		if len(hashes) == 0 {
 			continue
 		}
 
+		if uid := entry.GetAttributeValue(cfg.LdapUIDAttr); len(uid) > 0 {
+			for _, hash := range hashes {
+				uidWrite(hash, uid)
+			}
+		}
+
+		// photos linked from LDAP are fetched on lookup by the url
+		// source, they may be on hosts that are slow or down
+		if len(cfg.LdapURLAttr) > 0 {
+			photoURL := entry.GetAttributeValue(cfg.LdapURLAttr)
+			for _, hash := range hashes {
+				photoURLWrite(hash, photoURL)
+			}
+		}
+
+		// users without a photo in LDAP may have one in PHOTO_DIRECTORY
+		source := sourceLDAP
 		av := entry.GetRawAttributeValue(cfg.LdapAvatarAttr)
 		if len(av) == 0 {
-			continue
+			source = sourceDirectory
+			av = directoryPhoto(hashes)
 		}
-
-		hash := fmt.Sprintf("%x", md5.Sum([]byte(mail))) // #nosec G401
-		avtr := hsGet(hash)
-		if len(avtr.Image) > 0 && time.Since(avtr.LastUpdate) <= maxTime {
+		if len(av) == 0 {
 			continue
 		}
 
-		fmt.Fprintln(os.Stderr, hash+" → LDAP")
-		hsWrite(hash, avatar{
-			Image:      av,
-			LastUpdate: time.Now(),
-		})
+		// the avatar is ingested once per entry and shared by its hashes
+		var stale []string
+
+		for _, hash := range hashes {
+			// a photo in LDAP replaces negative and Gravatar entries,
+			// unless it is the photo that was quarantined
+			cached := hsGet(hash)
+			fresh := len(cached.Image) > 0 && !cached.expired()
+			if !fresh || (cached.Source != source && !hsQuarantined(hash)) {
+				stale = append(stale, hash)
+			}
+		}
 
-		hash = fmt.Sprintf("%x", sha256.Sum256([]byte(mail)))
-		avtr = hsGet(hash)
-		if len(avtr.Image) > 0 && time.Since(avtr.LastUpdate) <= maxTime {
+		if len(stale) == 0 {
 			continue
 		}
 
-		fmt.Fprintln(os.Stderr, hash+" → LDAP")
-		hsWrite(hash, avatar{
-			Image:      av,
-			LastUpdate: time.Now(),
-		})
+		avtr := ingestAvatar(av, source, stale...)
+		for _, hash := range stale {
+			fmt.Fprintln(os.Stderr, hash+" → "+source)
+			hsWrite(hash, avtr)
+		}
+		queueRender(avtr, stale...)
 	}
 }
+
+type ldapSource struct{}
+
+func (ldapSource) name() string {
+	return sourceLDAP
+}
+
+// lookup picks the hash from the cache filled from LDAP. An expired LDAP
+// photo has LDAP read again at once, other misses only once the last read is
+// older than LDAP_REFRESH_INTERVAL. A quarantined LDAP photo is a hit too:
+// the default avatar it was replaced with is served rather than a photo from
+// the next source. Other negative entries are misses.
+func (ldapSource) lookup(ctx context.Context, req lookupRequest) (avatar, error) {
+	if err := refreshLDAP(ctx, req.cached.Source == sourceLDAP); err != nil {
+		return avatar{}, err
+	}
+
+	av := hsGet(req.hash)
+	if len(av.Image) == 0 && hsQuarantined(req.hash) {
+		av = newDefaultAvatar()
+	}
+
+	if len(av.Image) == 0 || (av.negative() && !hsQuarantined(req.hash)) {
+		return avatar{}, errNotFound
+	}
+
+	return av, nil
+}
+
+// refreshLDAP reads LDAP into the cache unless it was read within
+// LDAP_REFRESH_INTERVAL and force is false. Concurrent calls share one
+// read: those waiting for it do not read LDAP again.
+func refreshLDAP(ctx context.Context, force bool) error {
+	asked := time.Now()
+
+	select {
+	case ldapReading <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-ldapReading }()
+
+	ldapReadMu.Lock()
+	read := ldapRead
+	ldapReadMu.Unlock()
+
+	if read.After(asked) || (!force && time.Since(read) < time.Duration(cfg.LdapRefresh)*time.Second) {
+		return nil
+	}
+
+	return tryFillHash(ctx)
+}
+
+// refreshLDAPEvery reads LDAP every LDAP_REFRESH_INTERVAL, so photos added
+// there replace the negative entries of their hashes. Errors are logged, the
+// next refresh tries again.
+func refreshLDAPEvery() {
+	interval := time.Duration(cfg.LdapRefresh) * time.Second
+
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := refreshLDAP(ctx, true); err != nil {
+				fmt.Fprintln(os.Stderr, "× ldap: "+err.Error())
+			}
+			cancel()
+		}
+	}()
+}
+
+// tryFillHash is fillHashContext with the panics raised on LDAP errors
+// turned into an error.
+func tryFillHash(ctx context.Context) error {
+	var err error
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+
+		fillHashContext(ctx)
+	}()
+
+	return err
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/md5" // #nosec G501
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	libravatarService = "avatars-sec"
+
+	// what is served for hashes without a photo, see generator
+	defaultBlank      = "blank"
+	defaultImage      = "image"
+	defaultNotFound   = "404"
+	defaultRedirect   = "redirect"
+	generateIdenticon = "identicon"
+)
+
+var defaultAvatars = map[string]bool{
+	defaultBlank:      true,
+	defaultImage:      true,
+	defaultNotFound:   true,
+	generateIdenticon: true,
+}
+
+// defaultAliases maps the d values of Gravatar and Libravatar to what is
+// served: the mystery person is the default avatar and the generated
+// pictures without a generator here are identicons.
+var defaultAliases = map[string]string{
+	"mm":        defaultImage,
+	"mp":        defaultImage,
+	"monsterid": generateIdenticon,
+	"pagan":     generateIdenticon,
+	"retro":     generateIdenticon,
+	"robohash":  generateIdenticon,
+	"wavatar":   generateIdenticon,
+}
+
+var (
+	errNoServer = errors.New("no federated server")
+
+	// emails maps the hashes of LDAP users to their email address, so the
+	// server of their domain can be found; filled by fillHash
+	emails = map[string]string{}
+
+	// resolver looks up the SRV records of federated servers, replaced in
+	// tests
+	resolver srvResolver = net.DefaultResolver
+
+	// libravatars holds a client per federated server, so a failing
+	// server does not open the breaker for the others
+	libravatars   = map[string]*upstream{}
+	libravatarsMu sync.Mutex
+)
+
+// normalizeEmail returns mail the way it is hashed by Gravatar and Libravatar
+// clients: trimmed and lowercased.
+func normalizeEmail(mail string) string {
+	return strings.ToLower(strings.TrimSpace(mail))
+}
+
+// emailHashes returns the MD5 and SHA-256 hashes an avatar of mail is
+// requested by.
+func emailHashes(mail string) []string {
+	mail = normalizeEmail(mail)
+
+	return []string{
+		fmt.Sprintf("%x", md5.Sum([]byte(mail))), // #nosec G401
+		fmt.Sprintf("%x", sha256.Sum256([]byte(mail))),
+	}
+}
+
+// openidHash returns the SHA-256 hash Libravatar clients request the avatar
+// of an OpenID by: the URL with its scheme and host lowercased, the rest is
+// kept as is. The value may be a labeledURI, a URL followed by a label. An
+// empty string is returned for values that are not HTTP(S) URLs.
+func openidHash(value string) string {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	u, err := url.Parse(fields[0])
+	if err != nil || (!strings.EqualFold(u.Scheme, "http") && !strings.EqualFold(u.Scheme, "https")) || len(u.Host) == 0 {
+		return ""
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(u.String())))
+}
+
+// defaultParam returns the d or default query parameter.
+func defaultParam(q url.Values) string {
+	if d := q.Get("d"); len(d) > 0 {
+		return d
+	}
+
+	return q.Get("default")
+}
+
+// generator returns what is served instead of a missing photo: the d query
+// parameter, with the Libravatar values and URLs to redirect to, wins over
+// DEFAULT_AVATAR.
+func generator(q url.Values) string {
+	d := defaultParam(q)
+	if defaultAvatars[d] {
+		return d
+	}
+
+	if alias, ok := defaultAliases[d]; ok {
+		return alias
+	}
+
+	if len(redirectURL(d)) > 0 {
+		return defaultRedirect
+	}
+
+	return cfg.DefaultAvatar
+}
+
+// redirectURL returns d if it is an absolute HTTP(S) URL the client may be
+// redirected to.
+func redirectURL(d string) string {
+	u, err := url.Parse(d)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return ""
+	}
+
+	return u.String()
+}
+
+// forceDefault reports whether the client asks for the default avatar even
+// if there is a photo.
+func forceDefault(q url.Values) bool {
+	f := q.Get("f")
+	if len(f) == 0 {
+		f = q.Get("forcedefault")
+	}
+
+	return strings.EqualFold(f, "y")
+}
+
+// serveBlank writes a transparent avatar: as SVG if negotiated, otherwise
+// as PNG (or the format asked for) of the device size. Formats without an
+// alpha channel get a plain bg square.
+func serveBlank(w http.ResponseWriter, r *http.Request, req avatarRequest) {
+	if svgFormat(r, req.format) {
+		s := strconv.FormatUint(req.cssSize, 10)
+		w.Header().Set(cspHeader, cspValue)
+		w.Header().Set(nosniffHeader, nosniffValue)
+		writeAvatar(w, []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="`+s+`" height="`+s+`"/>`),
+			formatSvg, image.Pt(int(req.cssSize), int(req.cssSize))) // #nosec G115
+
+		return
+	}
+
+	format := outputFormat(r, req.format, formatPng)
+
+	var img image.Image = image.NewNRGBA(image.Rect(0, 0, int(req.size), int(req.size))) // #nosec G115
+	if format == formatJpeg || format == formatGif {
+		img = flatten(img, req.bg)
+	}
+
+	data, err := encodeAvatar(img, format, renderOptionsFor(req.size))
+	panicIf(err, "while encoding blank avatar")
+
+	writeAvatar(w, data, format, img.Bounds().Size())
+}
+
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+func emailWrite(h, mail string) {
+	lock.Lock()
+	emails[h] = mail
+	lock.Unlock()
+}
+
+func emailGet(h string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return emails[h]
+}
+
+// emailDomain returns the domain of the LDAP user whose email hashes to h, or
+// an empty string if h is unknown.
+func emailDomain(h string) string {
+	_, domain, _ := strings.Cut(emailGet(h), "@")
+
+	return strings.ToLower(domain)
+}
+
+// hintDomain returns the domain given in the domain query parameter if it
+// is one of LIBRAVATAR_DOMAINS. Other domains are ignored: avatars are
+// cached by hash, so any client could otherwise have the avatar of a hash
+// fetched from a server of its choosing.
+func hintDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if len(domain) > 0 && slices.ContainsFunc(cfg.LibravatarHints, func(d string) bool {
+		return strings.EqualFold(d, domain)
+	}) {
+		return domain
+	}
+
+	return ""
+}
+
+// libravatarServer resolves the secure Libravatar server of domain: the
+// record with the lowest priority and, among those, the highest weight.
+func libravatarServer(ctx context.Context, domain string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.DialTimeout)*time.Second)
+	defer cancel()
+
+	_, addrs, err := resolver.LookupSRV(ctx, libravatarService, "tcp", domain)
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound || err == nil && len(addrs) == 0 {
+		return "", errNoServer
+	}
+	if err != nil {
+		return "", err
+	}
+
+	srv := slices.MinFunc(addrs, func(a, b *net.SRV) int {
+		if a.Priority != b.Priority {
+			return int(a.Priority) - int(b.Priority)
+		}
+
+		return int(b.Weight) - int(a.Weight)
+	})
+
+	host := strings.TrimSuffix(srv.Target, ".")
+	if len(host) == 0 {
+		return "", errNoServer
+	}
+	if srv.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+	}
+
+	return host, nil
+}
+
+func libravatarUpstream(host string) (*upstream, error) {
+	libravatarsMu.Lock()
+	defer libravatarsMu.Unlock()
+
+	if u, ok := libravatars[host]; ok {
+		return u, nil
+	}
+
+	u, err := newUpstream("Libravatar " + host)
+	if err != nil {
+		return nil, err
+	}
+	libravatars[host] = u
+
+	return u, nil
+}
+
+// fetchLibravatar gets the avatar of h from the Libravatar server federated
+// for domain, asking for a 404 if there is none.
+func fetchLibravatar(ctx context.Context, h, domain, etag, lastModified string) (fetched, error) {
+	host, err := libravatarServer(ctx, domain)
+	if err != nil {
+		return fetched{}, err
+	}
+
+	u, err := libravatarUpstream(host)
+	if err != nil {
+		return fetched{}, err
+	}
+
+	return u.fetch(ctx, "https://"+host+"/avatar/"+h+"?s=490&d="+strconv.Itoa(http.StatusNotFound), etag, lastModified)
+}
+
+type libravatarSource struct{}
+
+func (libravatarSource) name() string {
+	return sourceLibravatar
+}
+
+// lookup asks the Libravatar server of the domain of the LDAP user the hash
+// belongs to or, for hashes not in LDAP, of the hinted domain.
+func (libravatarSource) lookup(ctx context.Context, req lookupRequest) (avatar, error) {
+	domain := emailDomain(req.hash)
+	if len(domain) == 0 {
+		domain = req.domain
+	}
+	if len(domain) == 0 {
+		return avatar{}, errNotFound
+	}
+
+	return refreshUpstream(req, sourceLibravatar, func(etag, lastModified string) (fetched, error) {
+		return fetchLibravatar(ctx, req.hash, domain, etag, lastModified)
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubResolver answers SRV lookups from a map of domains.
+type stubResolver map[string][]*net.SRV
+
+func (s stubResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if service != libravatarService || proto != "tcp" {
+		return "", nil, errors.New("unexpected lookup of " + service + "." + proto)
+	}
+
+	addrs, ok := s[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return "", addrs, nil
+}
+
+func withResolver(t *testing.T, r srvResolver) {
+	t.Helper()
+
+	old := resolver
+	resolver = r
+	t.Cleanup(func() { resolver = old })
+}
+
+func TestLibravatarServer(t *testing.T) {
+	parseTestConfig(t)
+	withResolver(t, stubResolver{
+		"example.org": {
+			{Target: "backup.example.org.", Port: 443, Priority: 20, Weight: 100},
+			{Target: "light.example.org.", Port: 443, Priority: 10, Weight: 1},
+			{Target: "avatars.example.org.", Port: 8443, Priority: 10, Weight: 50},
+		},
+		"example.net": {{Target: ".", Port: 443}},
+	})
+
+	if got, err := libravatarServer(context.Background(), "example.org"); err != nil || got != "avatars.example.org:8443" {
+		t.Errorf("Want 'avatars.example.org:8443', got '%s' (%v)", got, err)
+	}
+
+	for _, domain := range []string{"example.com", "example.net"} {
+		if _, err := libravatarServer(context.Background(), domain); !errors.Is(err, errNoServer) {
+			t.Errorf("%s: want no server error, got %v", domain, err)
+		}
+	}
+}
+
+func TestHintDomain(t *testing.T) {
+	t.Setenv("LIBRAVATAR_DOMAINS", "partner.example,Other.Example")
+	parseTestConfig(t)
+
+	tests := map[string]string{
+		"partner.example":  "partner.example",
+		"PARTNER.example.": "partner.example",
+		"other.example":    "other.example",
+		"evil.example":     "",
+		"":                 "",
+	}
+
+	for hint, want := range tests {
+		if got := hintDomain(hint); got != want {
+			t.Errorf("%s: want '%s', got '%s'", hint, want, got)
+		}
+	}
+}
+
+func TestLibravatarSource(t *testing.T) {
+	const m, p string = "cdcdcdcdcdcdcdcdcdcdcdcdcdcdcdcd", "efefefefefefefefefefefefefefefef"
+
+	photo := testJpeg(t, 64, 64)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/avatar/"+m {
+			http.NotFound(w, r)
+
+			return
+		}
+		_, _ = w.Write(photo)
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("UPSTREAM_CA_FILE", caFile)
+	parseTestConfig(t)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withResolver(t, stubResolver{
+		"partner.example": {{Target: u.Hostname() + ".", Port: uint16(port)}}, // #nosec G115
+	})
+
+	hs = map[string]avatar{}
+	emails = map[string]string{}
+	libravatars = map[string]*upstream{}
+
+	src := libravatarSource{}
+	ctx := context.Background()
+
+	if _, err := src.lookup(ctx, lookupRequest{hash: m}); !errors.Is(err, errNotFound) {
+		t.Errorf("Want no lookup without a known email or domain hint, got %v", err)
+	}
+
+	// the domain of a known LDAP user is used
+	emailWrite(m, "jane@Partner.Example")
+
+	av, err := src.lookup(ctx, lookupRequest{hash: m})
+	if err != nil || av.Source != sourceLibravatar {
+		t.Fatalf("Want avatar from Libravatar, got source '%s' (%v)", av.Source, err)
+	}
+
+	// a hint for unknown hashes, a miss falls through to the next source
+	if _, err := src.lookup(ctx, lookupRequest{hash: p, domain: "partner.example"}); !errors.Is(err, errNotFound) {
+		t.Errorf("Want a miss for a hash unknown to the federated server, got %v", err)
+	}
+
+	if _, err := src.lookup(ctx, lookupRequest{hash: p, domain: "unknown.example"}); !errors.Is(err, errNoServer) {
+		t.Errorf("Want a miss for a domain without a federated server, got %v", err)
+	}
+}
+
+func TestEmailHashes(t *testing.T) {
+	want := []string{
+		"55502f40dc8b7c769880b10874abc9d0",
+		"973dfe463ec85785f5f95af5ba3906eedb2d931c24e69824a89ea65dba4e813b",
+	}
+
+	for _, mail := range []string{"test@example.com", " Test@Example.COM\n"} {
+		if got := emailHashes(mail); !slices.Equal(got, want) {
+			t.Errorf("'%s': want %v, got %v", mail, want, got)
+		}
+	}
+}
+
+func TestOpenIDHash(t *testing.T) {
+	const want = "ca3ef9e1be266d08f64735177d5f0fa9d15496ae4579a4f299bafeb400ecaf8c"
+
+	tests := map[string]string{
+		"https://example.com/ID/User":           want,
+		"HTTPS://Example.COM/ID/User":           want,
+		"https://example.com/ID/User My OpenID": want,
+		"mailto:user@example.com":               "",
+		"https:///ID/User":                      "",
+		"":                                      "",
+	}
+
+	for uri, hash := range tests {
+		if got := openidHash(uri); got != hash {
+			t.Errorf("'%s': want '%s', got '%s'", uri, hash, got)
+		}
+	}
+
+	// the path is case sensitive
+	if got := openidHash("https://example.com/id/user"); got == want {
+		t.Error("Want the path kept as is")
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	t.Setenv("DEFAULT_AVATAR", "identicon")
+	parseTestConfig(t)
+
+	tests := map[string]string{
+		"":                                    generateIdenticon,
+		"d=404":                               defaultNotFound,
+		"d=mm":                                defaultImage,
+		"default=mp":                          defaultImage,
+		"d=retro":                             generateIdenticon,
+		"d=blank":                             defaultBlank,
+		"d=https%3A%2F%2Fexample.com%2Fa.png": defaultRedirect,
+		"d=javascript%3Aalert(1)":             generateIdenticon,
+		"d=unknown":                           generateIdenticon,
+	}
+
+	for query, want := range tests {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := generator(q); got != want {
+			t.Errorf("'%s': want '%s', got '%s'", query, want, got)
+		}
+	}
+}
+
+// TestLibravatarConformance checks the responses the Libravatar protocol expects
+// for the d, f and s parameters.
+func TestLibravatarConformance(t *testing.T) {
+	const (
+		m = "56565656565656565656565656565656"
+		p = "7878787878787878787878787878787878787878787878787878787878787878"
+
+		nobody = "https://example.com/nobody.png"
+	)
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{
+		m: newDefaultAvatar(),
+		p: {Image: testJpeg(t, 60, 60), LastUpdate: time.Now(), Source: sourceLDAP},
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		source   string
+		location string
+		width    string
+	}{
+		{m + "?d=404", http.StatusNotFound, sourceDefault, "", ""},
+		{strings.ToUpper(m) + "?default=404", http.StatusNotFound, sourceDefault, "", ""},
+		{m + "?d=" + url.QueryEscape(nobody), http.StatusFound, sourceDefault, nobody, ""},
+		{m + "?d=blank&s=40", http.StatusOK, sourceGenerated, "", "40"},
+		{m + "?d=identicon&size=32", http.StatusOK, sourceGenerated, "", "32"},
+		{m + "?d=monsterid&s=32", http.StatusOK, sourceGenerated, "", "32"},
+		{p + "?d=404&s=48", http.StatusOK, sourceLDAP, "", "48"},
+		{p + "?d=404&f=y", http.StatusNotFound, sourceDefault, "", ""},
+		{p + "?d=identicon&forcedefault=y&s=24", http.StatusOK, sourceGenerated, "", "24"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		avatarHandler(w, httptest.NewRequest("GET", "/avatar/"+tt.path, nil))
+
+		if w.Code != tt.status {
+			t.Errorf("%s: want status %d, got %d", tt.path, tt.status, w.Code)
+		}
+
+		if got := w.Header().Get("X-Avatar-Source"); got != tt.source {
+			t.Errorf("%s: want source '%s', got '%s'", tt.path, tt.source, got)
+		}
+
+		if got := w.Header().Get("Location"); got != tt.location {
+			t.Errorf("%s: want location '%s', got '%s'", tt.path, tt.location, got)
+		}
+
+		if got := w.Header().Get("X-Avatar-Width"); got != tt.width {
+			t.Errorf("%s: want width '%s', got '%s'", tt.path, tt.width, got)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+)
+
+const (
+	gifHeaderSize     = 13
+	gifDescriptorSize = 10
+)
+
+// quarantined maps hashes whose source image was rejected to the reason.
+var quarantined = make(map[string]string)
+
+func checkLimitsConfig() error {
+	if cfg.MaxImageBytes < 1 || cfg.MaxImagePixels < 1 {
+		return errors.New("MAX_IMAGE_BYTES and MAX_IMAGE_PIXELS must be positive")
+	}
+
+	return nil
+}
+
+// gifFrames counts the image descriptors of GIF data by walking its block
+// structure, without decompressing anything.
+func gifFrames(data []byte) int {
+	if len(data) < gifHeaderSize {
+		return 0
+	}
+
+	i := gifHeaderSize
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+
+	skipBlocks := func() {
+		for i < len(data) && data[i] != 0 {
+			i += 1 + int(data[i])
+		}
+		i++
+	}
+
+	frames := 0
+
+	for i < len(data) {
+		switch data[i] {
+		case 0x21: // extension: introducer, label, sub-blocks
+			i += 2
+			skipBlocks()
+		case 0x2c: // image descriptor, optional palette, LZW code size, sub-blocks
+			if i+gifDescriptorSize > len(data) {
+				return frames
+			}
+
+			if flags := data[i+9]; flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			i += gifDescriptorSize + 1
+			skipBlocks()
+
+			frames++
+		default: // trailer or garbage
+			return frames
+		}
+	}
+
+	return frames
+}
+
+// checkImage rejects data before it is fully decoded if it is too large,
+// cannot be parsed or would decode to more pixels than allowed; every frame
+// of an animated GIF counts.
+func checkImage(data []byte) error {
+	if int64(len(data)) > cfg.MaxImageBytes {
+		return fmt.Errorf("image is %d bytes, limit is %d", len(data), cfg.MaxImageBytes)
+	}
+
+	ic, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("malformed image: %w", err)
+	}
+
+	pixels := int64(ic.Width) * int64(ic.Height)
+	if format == formatGif {
+		pixels *= int64(max(gifFrames(data), 1))
+	}
+
+	if ic.Width <= 0 || ic.Height <= 0 {
+		return fmt.Errorf("image is %d×%d pixels", ic.Width, ic.Height)
+	}
+
+	if pixels > cfg.MaxImagePixels {
+		return fmt.Errorf("image decodes to %d pixels, limit is %d", pixels, cfg.MaxImagePixels)
+	}
+
+	return nil
+}
+
+// hsQuarantine records why the image of h was rejected, a nil err lifts
+// the quarantine.
+func hsQuarantine(h string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err == nil {
+		delete(quarantined, h)
+
+		return
+	}
+
+	quarantined[h] = err.Error()
+	fmt.Fprintln(os.Stderr, h+" × quarantine: "+err.Error())
+}
+
+func hsQuarantined(h string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	_, ok := quarantined[h]
+
+	return ok
+}
+
+// ingestAvatar wraps image data fetched from source for hashes into a cache
+// entry. Images failing the limits or decoding are quarantined and a
+// negative entry is returned in their place, so the offending bytes never
+// reach the handler.
+func ingestAvatar(data []byte, source string, hashes ...string) avatar {
+	av, err := recoverAvatar(data)
+	av.Source = source
+	for _, h := range hashes {
+		hsQuarantine(h, err)
+	}
+
+	if err != nil {
+		av = newDefaultAvatar()
+	}
+
+	return av
+}
+
+// recoverAvatar is newAvatar with a panic in the decoders turned into an
+// error. Photos are also ingested by background loaders, where no handler
+// recovers and a crafted image would take the server down.
+func recoverAvatar(data []byte) (avatar, error) {
+	var (
+		av  avatar
+		err error
+	)
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				av, err = avatar{}, fmt.Errorf("image crashed the decoder: %v", r)
+			}
+		}()
+
+		av, err = newAvatar(data)
+	}()
+
+	return av, err
+}
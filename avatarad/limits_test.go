@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGifFrames(t *testing.T) {
+	data := testAnimation(t)
+
+	if got := gifFrames(data); got != 3 {
+		t.Errorf("Want 3 frames, got %d", got)
+	}
+
+	for _, broken := range [][]byte{nil, []byte("GIF89a"), data[:len(data)/2]} {
+		if got := gifFrames(broken); got > 3 {
+			t.Errorf("Want at most 3 frames for truncated data, got %d", got)
+		}
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	t.Setenv("MAX_IMAGE_BYTES", "100000")
+	t.Setenv("MAX_IMAGE_PIXELS", "25000")
+	parseTestConfig(t)
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"small", testJpeg(t, 100, 100), ""},
+		{"malformed", []byte("not an image"), "malformed image"},
+		{"truncated header", testJpeg(t, 100, 100)[:10], "malformed image"},
+		{"too many pixels", testJpeg(t, 200, 200), "pixels"},
+		// 3 frames of 100×100 pixels
+		{"animation", testAnimation(t), "30000 pixels"},
+		{"too many bytes", bytes.Repeat([]byte{0}, 100001), "bytes"},
+	}
+
+	for _, tt := range tests {
+		err := checkImage(tt.data)
+
+		switch {
+		case len(tt.want) == 0 && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		case len(tt.want) > 0 && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: want error containing '%s', got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestLimitsConfig(t *testing.T) {
+	parseTestConfig(t)
+
+	cfg.MaxImagePixels = 0
+	if err := checkConfig(); err == nil {
+		t.Error("Want error for zero pixel limit")
+	}
+}
+
+func TestIngestAvatarQuarantine(t *testing.T) {
+	const (
+		m = "44444444444444444444444444444444"
+		s = "5555555555555555555555555555555555555555555555555555555555555555"
+	)
+
+	t.Setenv("MAX_IMAGE_PIXELS", "10000")
+	parseTestConfig(t)
+
+	av := ingestAvatar(testJpeg(t, 200, 200), sourceLDAP, m, s)
+	if !bytes.Equal(av.Image, newDefaultAvatar().Image) || !av.negative() {
+		t.Error("Want default avatar in place of a quarantined image")
+	}
+
+	for _, h := range []string{m, s} {
+		if reason := quarantined[h]; !strings.Contains(reason, "pixels") {
+			t.Errorf("Want %s quarantined for its size, got reason '%s'", h, reason)
+		}
+	}
+
+	if av := ingestAvatar(testJpeg(t, 50, 50), sourceLDAP, m); av.Format != formatJpeg || av.Source != sourceLDAP {
+		t.Error("Want valid image to be cached")
+	}
+
+	if reason, ok := quarantined[m]; ok {
+		t.Errorf("Want quarantine lifted for a valid image, got reason '%s'", reason)
+	}
+}
+
+func TestIngestAvatarPanic(t *testing.T) {
+	const m string = "66666666666666666666666666666666"
+
+	parseTestConfig(t)
+
+	// a format whose decoder panics past a valid header, like a crafted
+	// image hitting a decoder bug
+	image.RegisterFormat("crash", "CRASH", func(io.Reader) (image.Image, error) {
+		panic("decoder bug")
+	}, func(io.Reader) (image.Config, error) {
+		return image.Config{ColorModel: color.RGBAModel, Width: 1, Height: 1}, nil
+	})
+
+	av := ingestAvatar([]byte("CRASH"), sourceDirectory, m)
+	if !av.negative() {
+		t.Error("Want default avatar in place of an image crashing the decoder")
+	}
+
+	if reason := quarantined[m]; !strings.Contains(reason, "decoder bug") {
+		t.Errorf("Want %s quarantined for the crash, got reason '%s'", m, reason)
+	}
+}
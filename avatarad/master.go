@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+)
+
+const masterJpegQuality = 95
+
+var masterFormats = map[string]bool{
+	formatJpeg: true,
+	formatPng:  true,
+}
+
+func checkMasterConfig() error {
+	if cfg.MasterMaxSize < 1 {
+		return errors.New("MASTER_MAX_SIZE must be positive")
+	}
+
+	if !masterFormats[cfg.MasterFormat] {
+		return errors.New("unsupported master format " + cfg.MasterFormat)
+	}
+
+	return nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// masterFormat returns the format the master of img is encoded in: JPEG
+// masters of images with transparency are kept PNG, JPEG has no alpha.
+func masterFormat(img image.Image) string {
+	if o, ok := img.(interface{ Opaque() bool }); cfg.MasterFormat == formatJpeg && (!ok || !o.Opaque()) {
+		return formatPng
+	}
+
+	return cfg.MasterFormat
+}
+
+// normalize turns source image data into the master every response is
+// rendered from: decoded within the limits, converted to sRGB, turned
+// upright, downsized to MASTER_MAX_SIZE and encoded as MASTER_FORMAT.
+// Animations are validated only and kept as they are. The decoded master
+// and the format of the source are returned along with it.
+func normalize(data []byte) ([]byte, image.Image, string, error) {
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return nil, nil, format, err
+	}
+
+	if format == formatGif && gifFrames(data) > 1 {
+		return data, img, format, nil
+	}
+
+	limit := uint(cfg.MasterMaxSize)
+	if b := img.Bounds(); b.Dx() >= b.Dy() && b.Dx() > int(limit) {
+		img = scaleImage(img, limit, 0, filterLanczos3)
+	} else if b.Dy() > b.Dx() && b.Dy() > int(limit) {
+		img = scaleImage(img, 0, limit, filterLanczos3)
+	}
+
+	master, err := encodeAvatar(img, masterFormat(img), renderOptions{
+		jpegQuality: masterJpegQuality,
+		pngLevel:    png.BestSpeed,
+	})
+	if err != nil {
+		return nil, nil, format, err
+	}
+
+	return master, img, format, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	t.Setenv("MASTER_MAX_SIZE", "512")
+	parseTestConfig(t)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+		size   image.Point
+	}{
+		{"landscape", testJpeg(t, 1500, 1000), formatJpeg, image.Pt(512, 341)},
+		{"portrait", testJpeg(t, 200, 600), formatJpeg, image.Pt(171, 512)},
+		{"small", testJpeg(t, 100, 80), formatJpeg, image.Pt(100, 80)},
+		// orientation 6 turns the photo by 90°
+		{"oriented", withExif(t, testJpeg(t, 600, 300), binary.BigEndian, 6), formatJpeg, image.Pt(256, 512)},
+	}
+
+	for _, tt := range tests {
+		av, err := newAvatar(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v while normalizing", tt.name, err)
+		}
+
+		ic, format, err := image.DecodeConfig(bytes.NewReader(av.Image))
+		if err != nil || format != tt.format || image.Pt(ic.Width, ic.Height) != tt.size {
+			t.Errorf("%s: want %s master of %v, got %s of %d×%d (%v)",
+				tt.name, tt.format, tt.size, format, ic.Width, ic.Height, err)
+		}
+
+		if av.Format != formatJpeg {
+			t.Errorf("%s: want source format jpeg, got %s", tt.name, av.Format)
+		}
+
+		if av.Checksum != checksum(av.Image) || len(av.Checksum) != 64 {
+			t.Errorf("%s: want SHA-256 checksum of the master, got %s", tt.name, av.Checksum)
+		}
+
+		if bytes.Contains(av.Image, []byte("Exif")) {
+			t.Errorf("%s: want metadata stripped from the master", tt.name)
+		}
+	}
+
+	cfg.MasterFormat = formatPng
+	if av, err := newAvatar(testJpeg(t, 100, 80)); err != nil || !bytes.HasPrefix(av.Image, []byte("\x89PNG")) {
+		t.Errorf("Want PNG master, got error %v", err)
+	}
+
+	anim := testAnimation(t)
+	if av, err := newAvatar(anim); err != nil || !bytes.Equal(av.Image, anim) || av.Format != formatGif {
+		t.Errorf("Want animation kept as it is, got error %v", err)
+	}
+}
+
+// testTransparentPng returns a PNG with a transparent half.
+func testTransparentPng(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	draw.Draw(img, image.Rect(0, 0, 20, 40), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("%v while encoding test image", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestNormalizeTransparent(t *testing.T) {
+	parseTestConfig(t)
+
+	// JPEG has no alpha, transparency is kept in a PNG master
+	if av, err := newAvatar(testTransparentPng(t)); err != nil || !bytes.HasPrefix(av.Image, []byte("\x89PNG")) {
+		t.Errorf("Want PNG master of a transparent image, got error %v", err)
+	}
+}
+
+func TestMasterConfig(t *testing.T) {
+	parseTestConfig(t)
+
+	cfg.MasterFormat = formatWebp
+	if err := checkConfig(); err == nil {
+		t.Error("Want error for a master format that cannot be decoded")
+	}
+}
+
+func TestHandleAvatarMaster(t *testing.T) {
+	const m string = "dddddddddddddddddddddddddddddddd"
+
+	parseTestConfig(t)
+
+	av, err := newAvatar(testJpeg(t, 120, 160))
+	if err != nil {
+		t.Fatalf("%v while normalizing", err)
+	}
+
+	hs = map[string]avatar{m: av}
+
+	w := httptest.NewRecorder()
+	avatarHandler(w, httptest.NewRequest("GET", "/avatar/"+m+"?s=40", nil))
+
+	// the master is a PNG, the response keeps the format of the photo
+	if got, want := w.Header().Get("Content-Type"), "image/jpeg"; got != want {
+		t.Errorf("Want content type '%s', got '%s'", want, got)
+	}
+}
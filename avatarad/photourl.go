@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	errHostNotAllowed = errors.New("host not in PHOTO_URL_HOSTS")
+
+	// photoURLs maps the hashes of LDAP users to the URL of their photo,
+	// filled by fillHash
+	photoURLs = map[string]string{}
+
+	// photoHosts holds a client per photo host, so a failing host does not
+	// open the breaker for the others
+	photoHosts   = map[string]*upstream{}
+	photoHostsMu sync.Mutex
+)
+
+func checkPhotoURLConfig() error {
+	if len(cfg.LdapURLAttr) > 0 && len(cfg.PhotoURLHosts) == 0 {
+		return errors.New("PHOTO_URL_HOSTS must be set along with LDAP_PHOTO_URL_ATTRIBUTE")
+	}
+
+	return nil
+}
+
+// hostAllowed reports whether host is listed in PHOTO_URL_HOSTS, either
+// exactly or, for entries starting with a dot, as a subdomain.
+func hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, allowed := range cfg.PhotoURLHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPhotoURL returns the URL of a value of the photo URL attribute, which
+// may be a labeledURI (a URL followed by a label), if it is an HTTP(S) URL
+// of an allowed host.
+func checkPhotoURL(value string) (*url.URL, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return nil, errNotFound
+	}
+
+	u, err := url.Parse(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 || u.User != nil {
+		return nil, errors.New("not an HTTP(S) URL: " + fields[0])
+	}
+
+	if !hostAllowed(u.Hostname()) {
+		return nil, errHostNotAllowed
+	}
+
+	return u, nil
+}
+
+func photoURLWrite(h, photoURL string) {
+	lock.Lock()
+	photoURLs[h] = photoURL
+	lock.Unlock()
+}
+
+func photoURLGet(h string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return photoURLs[h]
+}
+
+// photoHost returns the client for a photo host. Redirects are followed to
+// allowed hosts only.
+func photoHost(host string) (*upstream, error) {
+	photoHostsMu.Lock()
+	defer photoHostsMu.Unlock()
+
+	if u, ok := photoHosts[host]; ok {
+		return u, nil
+	}
+
+	u, err := newUpstream(host)
+	if err != nil {
+		return nil, err
+	}
+
+	u.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		if _, err := checkPhotoURL(req.URL.String()); err != nil {
+			return err
+		}
+
+		return nil
+	}
+	photoHosts[host] = u
+
+	return u, nil
+}
+
+type urlSource struct{}
+
+func (urlSource) name() string {
+	return sourceURL
+}
+
+// lookup fetches the photo the LDAP user of the hash links to.
+func (urlSource) lookup(ctx context.Context, req lookupRequest) (avatar, error) {
+	raw := photoURLGet(req.hash)
+	if len(raw) == 0 {
+		return avatar{}, errNotFound
+	}
+
+	u, err := checkPhotoURL(raw)
+	if err != nil {
+		return avatar{}, err
+	}
+
+	client, err := photoHost(u.Host)
+	if err != nil {
+		return avatar{}, err
+	}
+
+	return refreshUpstream(req, sourceURL, func(etag, lastModified string) (fetched, error) {
+		return client.fetch(ctx, u.String(), etag, lastModified)
+	})
+}
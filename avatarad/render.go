@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxJpegQuality = 100
+	minJpegQuality = 1
+)
+
+// renderOptions control resampling and encoding of a response.
+type renderOptions struct {
+	filter        string
+	jpegQuality   int
+	pngLevel      png.CompressionLevel
+	sharpenAmount float64
+	sharpenRadius float64
+}
+
+// sizeBand overrides render options for sizes up to maxSize.
+type sizeBand struct {
+	maxSize uint64
+	opts    renderOptions
+}
+
+var pngLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+var (
+	defaultRender = renderOptions{
+		filter:      filterLanczos3,
+		jpegQuality: defaultJpegQuality,
+		pngLevel:    png.DefaultCompression,
+	}
+	sizeBands []sizeBand
+)
+
+// setRenderOption applies a single key=value setting to opts.
+func setRenderOption(opts *renderOptions, key, value string) error {
+	var err error
+
+	switch key {
+	case "filter":
+		if _, ok := filters[value]; !ok {
+			return errors.New("unsupported resampling filter " + value)
+		}
+		opts.filter = value
+	case "quality":
+		opts.jpegQuality, err = strconv.Atoi(value)
+		if err == nil && (opts.jpegQuality < minJpegQuality || opts.jpegQuality > maxJpegQuality) {
+			err = errors.New("JPEG quality must be in 1..100 range")
+		}
+	case "png":
+		level, ok := pngLevels[value]
+		if !ok {
+			return errors.New("unsupported PNG compression level " + value)
+		}
+		opts.pngLevel = level
+	case "sharpen":
+		opts.sharpenAmount, err = strconv.ParseFloat(value, 64)
+	case "radius":
+		opts.sharpenRadius, err = strconv.ParseFloat(value, 64)
+	default:
+		err = errors.New("unknown option " + key)
+	}
+
+	return err
+}
+
+// parseSizeBand parses "<max size>:<key>=<value>,…" starting from the global
+// render options.
+func parseSizeBand(s string) (sizeBand, error) {
+	band := sizeBand{opts: defaultRender}
+
+	size, settings, _ := strings.Cut(s, ":")
+
+	var err error
+	if band.maxSize, err = strconv.ParseUint(strings.TrimSpace(size), 10, 64); err != nil {
+		return band, fmt.Errorf("size band %q: %w", s, err)
+	}
+
+	for _, setting := range strings.Split(settings, ",") {
+		if len(strings.TrimSpace(setting)) == 0 {
+			continue
+		}
+
+		k, v, _ := strings.Cut(setting, "=")
+		if err := setRenderOption(&band.opts, strings.TrimSpace(k), strings.TrimSpace(v)); err != nil {
+			return band, fmt.Errorf("size band %q: %w", s, err)
+		}
+	}
+
+	return band, nil
+}
+
+// parseRenderConfig sets up the global render options and the size bands.
+func parseRenderConfig() error {
+	for _, kv := range [][2]string{
+		{"filter", cfg.ResampleFilter},
+		{"quality", strconv.Itoa(cfg.JpegQuality)},
+		{"png", cfg.PngCompression},
+	} {
+		if err := setRenderOption(&defaultRender, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	defaultRender.sharpenAmount = cfg.SharpenAmount
+	defaultRender.sharpenRadius = cfg.SharpenRadius
+
+	sizeBands = nil
+	for _, s := range cfg.SizeBands {
+		band, err := parseSizeBand(s)
+		if err != nil {
+			return err
+		}
+
+		sizeBands = append(sizeBands, band)
+	}
+
+	sort.Slice(sizeBands, func(i, j int) bool { return sizeBands[i].maxSize < sizeBands[j].maxSize })
+
+	return nil
+}
+
+// renderOptionsFor returns the options of the narrowest band holding size.
+func renderOptionsFor(size uint64) renderOptions {
+	for _, band := range sizeBands {
+		if size <= band.maxSize {
+			return band.opts
+		}
+	}
+
+	return defaultRender
+}
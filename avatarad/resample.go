@@ -0,0 +1,299 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"runtime"
+	"sync"
+)
+
+const (
+	filterBilinear   = "bilinear"
+	filterCatmullRom = "catmullrom"
+	filterLanczos3   = "lanczos3"
+	filterNearest    = "nearest"
+
+	// weights are fixed point numbers with weightBits fractional bits
+	weightBits = 14
+	weightOne  = 1 << weightBits
+	// reduceGap is how many times the box-reduced image must still be
+	// larger than the target before the filter is applied.
+	reduceGap = 2
+)
+
+// filter is a separable resampling kernel with the given support radius.
+type filter struct {
+	support float64
+	kernel  func(float64) float64
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+
+	x *= math.Pi
+
+	return math.Sin(x) / x
+}
+
+var filters = map[string]filter{
+	filterNearest: {},
+	filterBilinear: {1, func(x float64) float64 {
+		return max(1-math.Abs(x), 0)
+	}},
+	filterCatmullRom: {2, func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return (3*x*x*x - 5*x*x + 2) / 2
+		}
+
+		if x < 2 {
+			return (-x*x*x + 5*x*x - 8*x + 4) / 2
+		}
+
+		return 0
+	}},
+	filterLanczos3: {3, func(x float64) float64 {
+		if x > -3 && x < 3 {
+			return sinc(x) * sinc(x/3)
+		}
+
+		return 0
+	}},
+}
+
+// gaussian returns a filter used for blurring with standard deviation sigma.
+func gaussian(sigma float64) filter {
+	return filter{3 * sigma, func(x float64) float64 {
+		return math.Exp(-x * x / (2 * sigma * sigma))
+	}}
+}
+
+// contrib lists the weights of source pixels starting at start for one
+// destination pixel.
+type contrib struct {
+	start   int
+	weights []int32
+}
+
+// makeContribs computes the weights mapping srcLen pixels to dstLen ones.
+// When downscaling the kernel is stretched so every source pixel counts.
+func makeContribs(srcLen, dstLen int, f filter) []contrib {
+	scale := float64(srcLen) / float64(dstLen)
+	stretch := max(scale, 1)
+	support := f.support * stretch
+	contribs := make([]contrib, dstLen)
+
+	for i := range contribs {
+		center := (float64(i) + 0.5) * scale
+
+		if f.kernel == nil {
+			contribs[i] = contrib{min(int(center), srcLen-1), []int32{weightOne}}
+
+			continue
+		}
+
+		start := max(int(math.Floor(center-support)), 0)
+		end := min(int(math.Ceil(center+support)), srcLen)
+
+		weights := make([]float64, 0, end-start)
+		var sum float64
+		for j := start; j < end; j++ {
+			w := f.kernel((float64(j) + 0.5 - center) / stretch)
+			weights = append(weights, w)
+			sum += w
+		}
+
+		// normalize and put rounding leftovers on the largest weight so
+		// flat areas stay flat
+		c := contrib{start, make([]int32, len(weights))}
+		var total, peak int32
+		for j, w := range weights {
+			c.weights[j] = int32(math.Round(w / sum * weightOne))
+			total += c.weights[j]
+			if c.weights[j] > c.weights[peak] {
+				peak = int32(j) // #nosec G115
+			}
+		}
+		c.weights[peak] += weightOne - total
+
+		contribs[i] = c
+	}
+
+	return contribs
+}
+
+func clampPixel(v int32, hi uint8) uint8 {
+	v = (v + weightOne/2) >> weightBits
+	if v < 0 {
+		return 0
+	}
+
+	if v > int32(hi) {
+		return hi
+	}
+
+	return uint8(v) // #nosec G115
+}
+
+// convolveTransposed filters every row of src horizontally and writes the
+// result transposed into dst, so running it twice filters both axes.
+func convolveTransposed(src, dst *image.RGBA, contribs []contrib) {
+	rows := src.Rect.Dy()
+	workers := min(runtime.GOMAXPROCS(0), rows)
+	chunk := (rows + workers - 1) / workers
+
+	var wg sync.WaitGroup
+
+	for from := 0; from < rows; from += chunk {
+		wg.Add(1)
+
+		go func(from, to int) {
+			defer wg.Done()
+
+			for y := from; y < to; y++ {
+				row := src.Pix[y*src.Stride:]
+				for x, c := range contribs {
+					var r, g, b, a int32
+
+					p := row[c.start*4 : (c.start+len(c.weights))*4]
+					for _, w := range c.weights {
+						q := p[:4:4]
+						r += int32(q[0]) * w
+						g += int32(q[1]) * w
+						b += int32(q[2]) * w
+						a += int32(q[3]) * w
+						p = p[4:]
+					}
+
+					// premultiplied colour must not exceed alpha
+					out := dst.Pix[x*dst.Stride+y*4:]
+					out[3] = clampPixel(a, 0xff)
+					out[0] = clampPixel(r, out[3])
+					out[1] = clampPixel(g, out[3])
+					out[2] = clampPixel(b, out[3])
+				}
+			}
+		}(from, min(from+chunk, rows))
+	}
+
+	wg.Wait()
+}
+
+// toRGBA returns img as *image.RGBA with bounds starting at (0, 0).
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+
+	return rgba
+}
+
+// reduce averages k×k blocks of src, the blocks at the right and bottom
+// edges may be smaller.
+func reduce(src *image.RGBA, k int) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, (w+k-1)/k, (h+k-1)/k))
+	sums := make([]uint32, dst.Rect.Dx()*4)
+
+	for dy := range dst.Rect.Dy() {
+		clear(sums)
+
+		rows := min(k, h-dy*k)
+		for y := dy * k; y < dy*k+rows; y++ {
+			row := src.Pix[y*src.Stride : y*src.Stride+w*4]
+			for i := 0; i < len(sums); i += 4 {
+				sum := sums[i : i+4 : i+4]
+				block := row[i*k : min(i*k+k*4, len(row))]
+				for ; len(block) >= 4; block = block[4:] {
+					sum[0] += uint32(block[0])
+					sum[1] += uint32(block[1])
+					sum[2] += uint32(block[2])
+					sum[3] += uint32(block[3])
+				}
+			}
+		}
+
+		out := dst.Pix[dy*dst.Stride:]
+		for dx := range dst.Rect.Dx() {
+			n := uint32(rows * min(k, w-dx*k)) // #nosec G115
+			for c := range 4 {
+				out[dx*4+c] = uint8((sums[dx*4+c] + n/2) / n) // #nosec G115
+			}
+		}
+	}
+
+	return dst
+}
+
+// resample scales img to width×height using f on both axes. Large
+// downscales are box-reduced first, which is much faster and visually the
+// same.
+func resample(img image.Image, width, height int, f filter) *image.RGBA {
+	src := toRGBA(img)
+	if width <= 0 || height <= 0 || src.Rect.Empty() {
+		return image.NewRGBA(image.Rect(0, 0, max(width, 0), max(height, 0)))
+	}
+
+	if k := min(src.Rect.Dx()/width, src.Rect.Dy()/height) / reduceGap; k > 1 && f.kernel != nil {
+		src = reduce(src, k)
+	}
+
+	tmp := image.NewRGBA(image.Rect(0, 0, src.Rect.Dy(), width))
+	convolveTransposed(src, tmp, makeContribs(src.Rect.Dx(), width, f))
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	convolveTransposed(tmp, dst, makeContribs(src.Rect.Dy(), height, f))
+
+	return dst
+}
+
+// scaleImage resizes img to width×height with the named filter; a zero
+// width or height is computed from the aspect ratio of img.
+func scaleImage(img image.Image, width, height uint, name string) image.Image {
+	b := img.Bounds()
+	if b.Empty() {
+		return img
+	}
+
+	w, h := int(width), int(height) // #nosec G115
+	if w == 0 {
+		w = max(1, int(math.Round(float64(b.Dx()*h)/float64(b.Dy()))))
+	}
+
+	if h == 0 {
+		h = max(1, int(math.Round(float64(b.Dy()*w)/float64(b.Dx()))))
+	}
+
+	return resample(img, w, h, filters[name])
+}
+
+// sharpen applies an unsharp mask: amount times the difference between img
+// and its Gaussian blur with the given radius is added to img.
+func sharpen(img image.Image, amount, radius float64) image.Image {
+	if amount <= 0 || radius <= 0 {
+		return img
+	}
+
+	src := toRGBA(img)
+	blurred := resample(src, src.Rect.Dx(), src.Rect.Dy(), gaussian(radius))
+	dst := image.NewRGBA(src.Rect)
+
+	for i := 0; i < len(src.Pix); i += 4 {
+		a := src.Pix[i+3]
+		dst.Pix[i+3] = a
+
+		for c := range 3 {
+			v := float64(src.Pix[i+c]) + amount*(float64(src.Pix[i+c])-float64(blurred.Pix[i+c]))
+			dst.Pix[i+c] = uint8(math.Round(min(max(v, 0), float64(a))))
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func TestScaleImage(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(10, 10, 130, 170))
+	flat := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+	draw.Draw(src, src.Rect, image.NewUniform(flat), image.Point{}, draw.Src)
+
+	tests := []struct {
+		w, h uint
+		want image.Point
+	}{
+		{80, 0, image.Pt(80, 107)},
+		{0, 80, image.Pt(60, 80)},
+		{40, 40, image.Pt(40, 40)},
+		{300, 0, image.Pt(300, 400)},
+		{1, 1, image.Pt(1, 1)},
+	}
+
+	for name := range filters {
+		for _, tt := range tests {
+			got := scaleImage(src, tt.w, tt.h, name)
+
+			if got.Bounds().Size() != tt.want {
+				t.Errorf("%s %dx%d: want size %v, got %v", name, tt.w, tt.h, tt.want, got.Bounds().Size())
+
+				continue
+			}
+
+			// flat areas must stay flat, ringing included
+			for _, p := range []image.Point{{0, 0}, {tt.want.X / 2, tt.want.Y / 2}, tt.want.Sub(image.Pt(1, 1))} {
+				if c := color.NRGBAModel.Convert(got.At(p.X, p.Y)); c != flat {
+					t.Errorf("%s %dx%d: want %v at %v, got %v", name, tt.w, tt.h, flat, p, c)
+				}
+			}
+		}
+	}
+}
+
+func TestScaleImageAlpha(t *testing.T) {
+	// opaque white square on a transparent background
+	src := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(src, image.Rect(25, 25, 75, 75), image.White, image.Point{}, draw.Src)
+
+	got := scaleImage(src, 20, 20, filterLanczos3)
+
+	if _, _, _, a := got.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("Want transparent corner, got alpha %d", a)
+	}
+
+	if c := color.NRGBAModel.Convert(got.At(10, 10)); c != (color.NRGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Errorf("Want white centre, got %v", c)
+	}
+}
+
+func TestSharpen(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(src, src.Rect, image.NewUniform(color.Gray{Y: 100}), image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(10, 0, 20, 20), image.NewUniform(color.Gray{Y: 150}), image.Point{}, draw.Src)
+
+	if got := sharpen(src, 0, 1); got != image.Image(src) {
+		t.Errorf("Want image untouched without sharpening")
+	}
+
+	got := sharpen(src, 1, 1)
+
+	dark, _, _, _ := got.At(9, 10).RGBA()
+	light, _, _, _ := got.At(10, 10).RGBA()
+	if dark>>8 >= 100 || light>>8 <= 150 {
+		t.Errorf("Want edge contrast increased, got %d and %d", dark>>8, light>>8)
+	}
+
+	if c, _, _, _ := got.At(0, 10).RGBA(); c>>8 != 100 {
+		t.Errorf("Want flat area untouched, got %d", c>>8)
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	t.Setenv("RESAMPLE_FILTER", filterCatmullRom)
+	t.Setenv("JPEG_QUALITY", "80")
+	t.Setenv("SIZE_BANDS", "512:quality=95,png=best; 48:filter=bilinear,sharpen=0.6,radius=0.8")
+	parseTestConfig(t)
+
+	tests := []struct {
+		size uint64
+		want renderOptions
+	}{
+		{32, renderOptions{filterBilinear, 80, png.DefaultCompression, 0.6, 0.8}},
+		{48, renderOptions{filterBilinear, 80, png.DefaultCompression, 0.6, 0.8}},
+		{80, renderOptions{filterCatmullRom, 95, png.BestCompression, 0, 0.5}},
+		{1024, renderOptions{filterCatmullRom, 80, png.DefaultCompression, 0, 0.5}},
+	}
+
+	for _, tt := range tests {
+		if got := renderOptionsFor(tt.size); got != tt.want {
+			t.Errorf("%d: want %+v, got %+v", tt.size, tt.want, got)
+		}
+	}
+
+	for _, bands := range []string{"big:quality=90", "48:quality=0", "48:filter=box", "48:png=max", "48:blur=1"} {
+		cfg.SizeBands = []string{bands}
+		if err := checkConfig(); err == nil {
+			t.Errorf("%q: want error", bands)
+		}
+	}
+}
+
+func benchmarkScaleImage(b *testing.B, name string) {
+	b.Helper()
+
+	src := image.NewYCbCr(image.Rect(0, 0, 1200, 1600), image.YCbCrSubsampleRatio420)
+	for i := range src.Y {
+		src.Y[i] = uint8(i)
+	}
+
+	for range b.N {
+		scaleImage(src, 256, 0, name)
+	}
+}
+
+func BenchmarkScaleImageNearest(b *testing.B)    { benchmarkScaleImage(b, filterNearest) }
+func BenchmarkScaleImageBilinear(b *testing.B)   { benchmarkScaleImage(b, filterBilinear) }
+func BenchmarkScaleImageCatmullRom(b *testing.B) { benchmarkScaleImage(b, filterCatmullRom) }
+func BenchmarkScaleImageLanczos3(b *testing.B)   { benchmarkScaleImage(b, filterLanczos3) }
+
+func BenchmarkSharpen(b *testing.B) {
+	src := image.NewRGBA(image.Rect(0, 0, 256, 256))
+
+	for range b.N {
+		sharpen(src, 0.5, 1)
+	}
+}
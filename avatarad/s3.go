@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat    = "20060102T150405Z"
+	amzMetaPrefix    = "X-Amz-Meta-"
+
+	// object key prefixes below S3_PREFIX
+	s3Photos   = "photos/"
+	s3Masters  = "masters/"
+	s3Variants = "variants/"
+)
+
+var (
+	// storage is the client for the S3-compatible object storage, set up
+	// in main if S3_ENDPOINT is set.
+	storage *s3Client
+
+	// pendingVariants holds the checksums of the avatars queued for
+	// pre-rendering, whose variants another replica may have shared
+	// already; they are dropped on a miss and once the ladder is rendered.
+	pendingVariants   = map[string]bool{}
+	pendingVariantsMu sync.Mutex
+)
+
+// s3Client reads and writes objects of a bucket, addressed path-style so
+// any S3-compatible server works, with requests signed by AWS Signature
+// Version 4.
+type s3Client struct {
+	*upstream
+	endpoint *url.URL
+	now      func() time.Time
+}
+
+func checkS3Config() error {
+	if len(cfg.S3Endpoint) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(cfg.S3Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.New("S3_ENDPOINT must be an HTTP(S) URL")
+	}
+
+	if len(cfg.S3Bucket) == 0 || len(cfg.S3Region) == 0 {
+		return errors.New("S3_BUCKET and S3_REGION must be set along with S3_ENDPOINT")
+	}
+
+	return nil
+}
+
+func newS3Client() (*s3Client, error) {
+	u, err := newUpstream("S3")
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.S3Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &s3Client{upstream: u, endpoint: endpoint, now: time.Now}
+	u.sign = c.sign
+
+	return c, nil
+}
+
+// awsEscape encodes s the way Signature Version 4 expects: everything but
+// unreserved characters, and slashes if keepSlash is set.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// objectURL returns the URL of the object key below S3_PREFIX.
+func (c *s3Client) objectURL(key string) string {
+	return c.endpoint.String() + "/" + awsEscape(cfg.S3Bucket, false) + "/" + awsEscape(cfg.S3Prefix+key, true)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// signedHeader reports whether a header is signed: the host, the content
+// type, ranges and all x-amz headers.
+func signedHeader(name string) bool {
+	return name == "host" || name == "content-type" || name == "range" || strings.HasPrefix(name, "x-amz-")
+}
+
+// sign adds the Signature Version 4 Authorization header to req, whose body
+// has the given SHA-256 hash.
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); signedHeader(name) {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonical strings.Builder
+
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	slices.Sort(params)
+
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		canonical.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + cfg.S3Region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(amzDateFormat) + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.S3SecretKey), date)
+	key = hmacSHA256(key, cfg.S3Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+cfg.S3AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+// get reads the object key, conditionally if etag is given.
+func (c *s3Client) get(ctx context.Context, key, etag string) (fetched, error) {
+	return c.fetch(ctx, c.objectURL(key), etag, "")
+}
+
+// put writes the object key with the given user metadata.
+func (c *s3Client) put(ctx context.Context, key string, data []byte, mime string, meta map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(userAgentHeader, c.userAgent)
+	req.Header.Set(contentType, mime)
+	for k, v := range meta {
+		req.Header.Set(amzMetaPrefix+k, v)
+	}
+
+	sum := sha256.Sum256(data)
+	c.sign(req, hex.EncodeToString(sum[:]))
+
+	if !c.breaker.allow() {
+		return errBreakerOpen
+	}
+
+	res, err := c.client.Do(req)
+	if err == nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s responded %s", c.name, res.Status)
+		}
+	}
+
+	c.breaker.record(err != nil)
+
+	return err
+}
+
+// putAsync writes an object in the background, requests do not wait for the
+// storage.
+func (c *s3Client) putAsync(key string, data []byte, mime string, meta map[string]string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.UpstreamTimeout)*time.Second)
+		defer cancel()
+
+		if err := c.put(ctx, key, data, mime, meta); err != nil {
+			fmt.Fprintln(os.Stderr, key+" × S3: "+err.Error())
+		}
+	}()
+}
+
+// s3CacheEnabled reports whether masters and variants are shared through
+// the object storage.
+func s3CacheEnabled() bool {
+	return storage != nil && cfg.S3Cache
+}
+
+func formatRect(r image.Rectangle) string {
+	return fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+}
+
+func parseRect(s string) image.Rectangle {
+	var r image.Rectangle
+
+	_, _ = fmt.Sscanf(s, "%d,%d,%d,%d", &r.Min.X, &r.Min.Y, &r.Max.X, &r.Max.Y)
+
+	return r
+}
+
+// shareMaster writes the cache entry of h to the object storage, so other
+// replicas need not ask the sources. Negative entries are not shared, they
+// expire soon anyway.
+func shareMaster(h string, av avatar) {
+	if !s3CacheEnabled() || av.negative() || len(av.Image) == 0 {
+		return
+	}
+
+	meta := map[string]string{
+		"Source":   av.Source,
+		"Format":   av.Format,
+		"Checksum": av.Checksum,
+		"Crop":     formatRect(av.Crop),
+		"Updated":  av.LastUpdate.UTC().Format(time.RFC3339Nano),
+	}
+	if av.MaxAge > 0 {
+		meta["Max-Age"] = strconv.FormatInt(int64(av.MaxAge/time.Second), 10)
+	}
+
+	storage.putAsync(s3Masters+h, av.Image, http.DetectContentType(av.Image), meta)
+}
+
+// sharedMaster reads the cache entry of h written by any replica, unless it
+// is expired.
+func sharedMaster(h string) (avatar, bool) {
+	if !s3CacheEnabled() {
+		return avatar{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.UpstreamTimeout)*time.Second)
+	defer cancel()
+
+	res, err := storage.get(ctx, s3Masters+h, "")
+	if err != nil {
+		if !errors.Is(err, errNotFound) {
+			fmt.Fprintln(os.Stderr, h+" × S3: "+err.Error())
+		}
+
+		return avatar{}, false
+	}
+
+	updated, err := time.Parse(time.RFC3339Nano, res.header.Get(amzMetaPrefix+"Updated"))
+	if err != nil {
+		return avatar{}, false
+	}
+
+	maxAge, _ := strconv.Atoi(res.header.Get(amzMetaPrefix + "Max-Age"))
+
+	av := avatar{
+		Image:      res.body,
+		LastUpdate: updated,
+		Crop:       parseRect(res.header.Get(amzMetaPrefix + "Crop")),
+		Format:     res.header.Get(amzMetaPrefix + "Format"),
+		Checksum:   res.header.Get(amzMetaPrefix + "Checksum"),
+		Source:     res.header.Get(amzMetaPrefix + "Source"),
+		MaxAge:     time.Duration(maxAge) * time.Second,
+	}
+
+	// the master was checked when it was ingested, but not by this
+	// replica, whose limits may be lower
+	if err := checkImage(av.Image); err != nil || av.negative() || av.expired() {
+		return avatar{}, false
+	}
+
+	return av, true
+}
+
+// renderFingerprint identifies the settings variants are rendered with, so
+// replicas configured differently do not share variants.
+func renderFingerprint() string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(cfg.FitMode, cfg.BackgroundColor, cfg.ResampleFilter,
+		cfg.JpegQuality, cfg.PngCompression, cfg.SharpenAmount, cfg.SharpenRadius, cfg.SizeBands,
+		cfg.UpscalePolicy, cfg.UpscaleFactor, cfg.Shape, cfg.CornerRadius)))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// variantKey returns the object key of a variant of the master with the
+// given checksum, by the size requested rather than the one served.
+func variantKey(checksum string, size uint64, format string) string {
+	return s3Variants + checksum + "/" + renderFingerprint() + "/" + strconv.FormatUint(size, 10) + "." + format
+}
+
+// shareLadder writes the pre-rendered variants of av to the object storage.
+func shareLadder(av avatar, l *ladder) {
+	if !s3CacheEnabled() || len(av.Checksum) == 0 {
+		return
+	}
+
+	for _, s := range cfg.LadderSizes {
+		size := clampSize(s)
+		r, ok := l.rungs[limitUpscale(size, l.bounds, cfg.FitMode, av.Crop)]
+		if !ok {
+			continue
+		}
+
+		dims := r.dims
+		for format, data := range r.encoded {
+			storage.putAsync(variantKey(av.Checksum, size, format), data, "image/"+format, map[string]string{
+				"Width":  strconv.Itoa(dims.X),
+				"Height": strconv.Itoa(dims.Y),
+			})
+		}
+	}
+}
+
+// expectVariants marks the variants of av as worth asking the object storage
+// for until its ladder is rendered.
+func expectVariants(av avatar, expected bool) {
+	if !s3CacheEnabled() || len(av.Checksum) == 0 {
+		return
+	}
+
+	pendingVariantsMu.Lock()
+	defer pendingVariantsMu.Unlock()
+
+	if expected {
+		pendingVariants[av.Checksum] = true
+	} else {
+		delete(pendingVariants, av.Checksum)
+	}
+}
+
+// sharedVariant reads a variant of av pre-rendered by any replica. Only
+// avatars waiting for their own ladder are asked for, and a miss is not
+// asked again, so requests do not wait for the storage every time.
+func sharedVariant(av avatar, size uint64, format string) ([]byte, image.Point, bool) {
+	if !s3CacheEnabled() || len(av.Checksum) == 0 || len(format) == 0 || av.negative() {
+		return nil, image.Point{}, false
+	}
+
+	pendingVariantsMu.Lock()
+	pending := pendingVariants[av.Checksum]
+	pendingVariantsMu.Unlock()
+
+	if !pending {
+		return nil, image.Point{}, false
+	}
+
+	// only the ladder sizes are shared, other sizes are not asked for
+	if !slices.ContainsFunc(cfg.LadderSizes, func(s uint64) bool { return clampSize(s) == size }) {
+		return nil, image.Point{}, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.UpstreamTimeout)*time.Second)
+	defer cancel()
+
+	res, err := storage.get(ctx, variantKey(av.Checksum, size, format), "")
+	if err != nil {
+		expectVariants(av, false)
+
+		return nil, image.Point{}, false
+	}
+
+	w, werr := strconv.Atoi(res.header.Get(amzMetaPrefix + "Width"))
+	h, herr := strconv.Atoi(res.header.Get(amzMetaPrefix + "Height"))
+	if werr != nil || herr != nil {
+		return nil, image.Point{}, false
+	}
+
+	return res.body, image.Pt(w, h), true
+}
+
+type s3Source struct{}
+
+func (s3Source) name() string {
+	return sourceS3
+}
+
+// lookup reads the photo object named by the hash or, for LDAP users, by
+// their email.
+func (s3Source) lookup(ctx context.Context, req lookupRequest) (avatar, error) {
+	keys := []string{s3Photos + req.hash}
+	if mail := emailGet(req.hash); len(mail) > 0 {
+		keys = append(keys, s3Photos+mail)
+	}
+
+	for _, key := range keys {
+		av, err := refreshUpstream(req, sourceS3, func(etag, _ string) (fetched, error) {
+			return storage.get(ctx, key, etag)
+		})
+		if !errors.Is(err, errNotFound) {
+			return av, err
+		}
+	}
+
+	return avatar{}, errNotFound
+}
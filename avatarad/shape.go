@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+const (
+	shapeCircle  = "circle"
+	shapeRounded = "rounded"
+	shapeSquare  = "square"
+)
+
+var shapes = map[string]bool{
+	shapeCircle:  true,
+	shapeRounded: true,
+	shapeSquare:  true,
+}
+
+func checkShapeConfig() error {
+	if !shapes[cfg.Shape] {
+		return errors.New("unsupported shape " + cfg.Shape)
+	}
+
+	if cfg.CornerRadius < 0 || cfg.CornerRadius > 0.5 {
+		return errors.New("CORNER_RADIUS must be within 0…0.5")
+	}
+
+	return nil
+}
+
+// shapeFormat returns the format a shaped avatar is served in when the
+// client did not ask for one: formats without an alpha channel are replaced
+// with PNG, so the corners stay transparent.
+func shapeFormat(format, shape string) string {
+	if shape != shapeSquare && (format == formatJpeg || format == formatGif) {
+		return formatPng
+	}
+
+	return format
+}
+
+// shapeDistance returns the signed distance in pixels from the point (x, y)
+// to the outline of the shape inscribed into a w×h box, negative inside.
+func shapeDistance(shape string, x, y, w, h float64) float64 {
+	// work in the upper left quadrant, the shapes are symmetric
+	hw, hh := w/2, h/2
+	dx, dy := math.Abs(x-hw), math.Abs(y-hh)
+
+	if shape == shapeCircle {
+		// ellipse approximation, exact for circles
+		return (math.Hypot(dx/hw, dy/hh) - 1) * min(hw, hh)
+	}
+
+	r := cfg.CornerRadius * min(w, h)
+	qx, qy := dx-(hw-r), dy-(hh-r)
+
+	return math.Hypot(max(qx, 0), max(qy, 0)) + min(max(qx, qy), 0) - r
+}
+
+// maskShape returns a copy of img with everything outside the shape made
+// transparent; the outline is anti-aliased by the pixel coverage.
+func maskShape(img image.Image, shape string) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+
+	w, h := float64(b.Dx()), float64(b.Dy())
+	for y := range b.Dy() {
+		for x := range b.Dx() {
+			coverage := min(max(0.5-shapeDistance(shape, float64(x)+0.5, float64(y)+0.5, w, h), 0), 1)
+			if coverage == 1 {
+				continue
+			}
+
+			// premultiplied colours scale with alpha
+			p := dst.Pix[dst.PixOffset(x, y):]
+			for c := range 4 {
+				p[c] = uint8(math.Round(float64(p[c]) * coverage))
+			}
+		}
+	}
+
+	return dst
+}
+
+// flatten draws img over bg, for formats without an alpha channel.
+func flatten(img image.Image, bg color.Color) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Over)
+
+	return dst
+}
+
+// finishImage sharpens a fitted image and applies the shape mask to it. The
+// masked-out area is filled with bg for formats without an alpha channel.
+func finishImage(img image.Image, opts renderOptions, shape string, bg color.Color, format string) image.Image {
+	img = sharpen(img, opts.sharpenAmount, opts.sharpenRadius)
+	if shape == shapeSquare {
+		return img
+	}
+
+	img = maskShape(img, shape)
+	if format == formatJpeg || format == formatGif {
+		img = flatten(img, bg)
+	}
+
+	return img
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaskShape(t *testing.T) {
+	parseTestConfig(t)
+
+	src := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(src, src.Rect, image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+	tests := []struct {
+		shape string
+		x, y  int
+		alpha uint8
+	}{
+		{shapeCircle, 0, 0, 0},
+		{shapeCircle, 50, 50, 255},
+		{shapeCircle, 50, 1, 255},
+		{shapeCircle, 10, 10, 0},
+		{shapeRounded, 0, 0, 0},
+		{shapeRounded, 50, 0, 255},
+		{shapeRounded, 15, 15, 255},
+		{shapeRounded, 3, 3, 0},
+	}
+
+	for _, tt := range tests {
+		got := maskShape(src, tt.shape).(*image.RGBA).RGBAAt(tt.x, tt.y)
+		if got.A != tt.alpha || got.R != tt.alpha {
+			t.Errorf("%s at %d,%d: want alpha %d, got %v", tt.shape, tt.x, tt.y, tt.alpha, got)
+		}
+	}
+
+	// the outline is anti-aliased
+	if a := maskShape(src, shapeCircle).(*image.RGBA).RGBAAt(50, 99).A; a == 0 || a == 255 {
+		t.Errorf("Want partial coverage on the outline, got alpha %d", a)
+	}
+
+	if src.RGBAAt(0, 0).A != 255 {
+		t.Error("Want source image untouched")
+	}
+}
+
+func TestHandleAvatarShape(t *testing.T) {
+	const m string = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testJpeg(t, 120, 160), LastUpdate: time.Now()}}
+
+	tests := []struct {
+		path   string
+		code   int
+		format string
+		corner color.Color
+	}{
+		{"?s=64&shape=circle", http.StatusOK, "png", color.RGBA{}},
+		{"?s=64&shape=rounded", http.StatusOK, "png", color.RGBA{}},
+		{".jpg?s=64&shape=circle&bg=00ff00", http.StatusOK, "jpeg", color.RGBA{G: 255, A: 255}},
+		{".gif?s=64&shape=circle&bg=0000ff", http.StatusOK, "gif", color.RGBA{B: 255, A: 255}},
+		{"?s=64&shape=star", http.StatusBadRequest, "", nil},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		avatarHandler(w, httptest.NewRequest("GET", "/avatar/"+m+tt.path, nil))
+
+		if w.Code != tt.code {
+			t.Errorf("%s: want response code %d, got %d", tt.path, tt.code, w.Code)
+
+			continue
+		}
+
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		img, format, err := image.Decode(w.Body)
+		if err != nil || format != tt.format {
+			t.Errorf("%s: want %s image, got %s (%v)", tt.path, tt.format, format, err)
+
+			continue
+		}
+
+		got := color.RGBAModel.Convert(img.At(0, 0)).(color.RGBA)
+		if _, _, _, a := tt.corner.RGBA(); uint32(got.A) != a>>8 || !closeColor(got, tt.corner, 8) {
+			t.Errorf("%s: want corner %v, got %v", tt.path, tt.corner, got)
+		}
+
+		if _, _, _, a := img.At(32, 32).RGBA(); a != 0xffff {
+			t.Errorf("%s: want opaque center, got alpha %d", tt.path, a)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+const (
+	defaultSize = 80
+
+	upscaleAllow    = "allow"
+	upscaleMultiple = "multiple"
+	upscaleOriginal = "original"
+
+	widthHeader  = "X-Avatar-Width"
+	heightHeader = "X-Avatar-Height"
+)
+
+var upscalePolicies = map[string]bool{
+	upscaleAllow:    true,
+	upscaleMultiple: true,
+	upscaleOriginal: true,
+}
+
+func checkSizeConfig() error {
+	if cfg.MinSize < 1 || cfg.MaxSize < cfg.MinSize {
+		return errors.New("size range must satisfy 1 ≤ MIN_SIZE ≤ MAX_SIZE")
+	}
+
+	if !upscalePolicies[cfg.UpscalePolicy] {
+		return errors.New("unsupported upscale policy " + cfg.UpscalePolicy)
+	}
+
+	if cfg.UpscaleFactor < 1 {
+		return errors.New("UPSCALE_FACTOR must not be less than 1")
+	}
+
+	return nil
+}
+
+// clampSize keeps the requested size within the configured range like
+// Gravatar does for its 1–2048 range.
+func clampSize(size uint64) uint64 {
+	return min(max(size, cfg.MinSize), cfg.MaxSize)
+}
+
+// limitUpscale caps size according to the upscale policy. The original size
+// is the side of the source region the output box is filled from: the crop
+// box for cropping, the longer side otherwise.
+func limitUpscale(size uint64, src image.Rectangle, mode string, crop image.Rectangle) uint64 {
+	original := max(src.Dx(), src.Dy())
+	if mode == fitCrop {
+		if crop.Empty() || !crop.In(src) {
+			crop = centerSquare(src)
+		}
+		original = crop.Dx()
+	}
+
+	limit := uint64(max(original, 1)) // #nosec G115
+
+	switch cfg.UpscalePolicy {
+	case upscaleOriginal:
+		return min(size, limit)
+	case upscaleMultiple:
+		return min(size, uint64(math.Floor(float64(limit)*cfg.UpscaleFactor)))
+	default:
+		return size
+	}
+}
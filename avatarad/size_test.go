@@ -0,0 +1,111 @@
+package main
+
+import (
+	"image"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+)
+
+func TestLimitUpscale(t *testing.T) {
+	src := image.Rect(0, 0, 120, 160)
+
+	tests := []struct {
+		policy string
+		mode   string
+		crop   image.Rectangle
+		size   uint64
+		want   uint64
+	}{
+		{upscaleAllow, fitCrop, image.Rectangle{}, 1000, 1000},
+		{upscaleOriginal, fitCrop, image.Rectangle{}, 1000, 120},
+		{upscaleOriginal, fitCrop, image.Rect(10, 10, 110, 110), 1000, 100},
+		{upscaleOriginal, fitContain, image.Rectangle{}, 1000, 160},
+		{upscaleOriginal, fitCrop, image.Rectangle{}, 80, 80},
+		{upscaleMultiple, fitCrop, image.Rectangle{}, 1000, 180},
+		{upscaleMultiple, fitPad, image.Rectangle{}, 1000, 240},
+	}
+
+	t.Setenv("UPSCALE_FACTOR", "1.5")
+
+	for _, tt := range tests {
+		t.Setenv("UPSCALE_POLICY", tt.policy)
+		parseTestConfig(t)
+
+		if got := limitUpscale(tt.size, src, tt.mode, tt.crop); got != tt.want {
+			t.Errorf("%s/%s %d: want %d, got %d", tt.policy, tt.mode, tt.size, tt.want, got)
+		}
+	}
+}
+
+func TestSizeConfig(t *testing.T) {
+	for _, kv := range [][2]string{
+		{"MIN_SIZE", "0"},
+		{"MAX_SIZE", "0"},
+		{"UPSCALE_POLICY", "never"},
+		{"UPSCALE_FACTOR", "0.5"},
+	} {
+		t.Run(kv[0], func(t *testing.T) {
+			parseTestConfig(t)
+
+			t.Setenv(kv[0], kv[1])
+			if err := env.Parse(&cfg); err != nil {
+				t.Fatalf("%v while reading configuration", err)
+			}
+
+			if err := checkConfig(); err == nil {
+				t.Errorf("%s=%s: want error", kv[0], kv[1])
+			}
+		})
+	}
+}
+
+func TestHandleAvatarSizeLimits(t *testing.T) {
+	const m string = "11111111111111111111111111111111"
+
+	t.Setenv("MAX_SIZE", "256")
+	parseTestConfig(t)
+
+	hs = map[string]avatar{m: {Image: testJpeg(t, 120, 160), LastUpdate: time.Now()}}
+
+	tests := []struct {
+		query  string
+		policy string
+		want   image.Point
+	}{
+		{"?s=100000", upscaleAllow, image.Pt(256, 256)},
+		{"?s=0", upscaleAllow, image.Pt(1, 1)},
+		{"?s=-5", upscaleAllow, image.Pt(80, 80)},
+		{"?s=200", upscaleOriginal, image.Pt(120, 120)},
+		{"?s=200&fit=contain", upscaleOriginal, image.Pt(120, 160)},
+		{"?s=100000", upscaleMultiple, image.Pt(240, 240)},
+	}
+
+	for _, tt := range tests {
+		cfg.UpscalePolicy = tt.policy
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/avatar/"+m+tt.query, nil)
+
+		avatarHandler(w, r)
+
+		ic, _, err := image.DecodeConfig(w.Body)
+		if err != nil {
+			t.Errorf("%s: %v while decoding response body", tt.query, err)
+
+			continue
+		}
+
+		if got := image.Pt(ic.Width, ic.Height); got != tt.want {
+			t.Errorf("%s (%s): want size %v, got %v", tt.query, tt.policy, tt.want, got)
+		}
+
+		width, height := w.Header().Get("X-Avatar-Width"), w.Header().Get("X-Avatar-Height")
+		if width != strconv.Itoa(tt.want.X) || height != strconv.Itoa(tt.want.Y) {
+			t.Errorf("%s: want dimension headers %v, got %s×%s", tt.query, tt.want, width, height)
+		}
+	}
+}
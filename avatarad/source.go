@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// avatarSource is a backend avatars are looked up in. Sources are asked in
+// the order of SOURCES until one of them has the avatar.
+type avatarSource interface {
+	// name is the source recorded in cache entries, used in SOURCES,
+	// SOURCE_TTLS and SOURCE_TIMEOUTS and in the metrics
+	name() string
+
+	// lookup returns the avatar of req.hash or errNotFound if the source
+	// has none. The context carries the SOURCE_TIMEOUTS deadline.
+	lookup(ctx context.Context, req lookupRequest) (avatar, error)
+}
+
+// lookupRequest is a hash to look up along with what is known about it.
+type lookupRequest struct {
+	hash string
+	// domain is the email domain given by the client, if any
+	domain string
+	// cached is the expired cache entry of the hash, for revalidation
+	cached avatar
+}
+
+// sourceMetrics counts the lookups of a source by outcome along with the
+// time spent in them.
+type sourceMetrics struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+	errors atomic.Int64
+	nanos  atomic.Int64
+}
+
+var (
+	// avatarSources holds the sources by name; a new backend is added
+	// here
+	avatarSources = map[string]avatarSource{
+		sourceLDAP:       ldapSource{},
+		sourceURL:        urlSource{},
+		sourceDirectory:  directorySource{},
+		sourceDatabase:   databaseSource{},
+		sourceS3:         s3Source{},
+		sourceLibravatar: libravatarSource{},
+		sourceGravatar:   gravatarSource{},
+	}
+
+	sourceTTLs     = map[string]time.Duration{}
+	sourceTimeouts = map[string]time.Duration{}
+
+	metrics   = map[string]*sourceMetrics{}
+	metricsMu sync.Mutex
+)
+
+// parseSourceDurations parses name=seconds pairs of known sources.
+func parseSourceDurations(name string, values []string) (map[string]time.Duration, error) {
+	durations := map[string]time.Duration{}
+
+	for _, v := range values {
+		src, secs, ok := strings.Cut(v, "=")
+		if _, known := avatarSources[src]; !known {
+			return nil, fmt.Errorf("%s: unknown source %s", name, src)
+		}
+
+		n, err := strconv.Atoi(secs)
+		if !ok || err != nil || n < 1 {
+			return nil, fmt.Errorf("%s: invalid number of seconds for %s", name, src)
+		}
+
+		durations[src] = time.Duration(n) * time.Second
+	}
+
+	return durations, nil
+}
+
+func checkSourcesConfig() error {
+	if cfg.LdapRefresh < 1 {
+		return errors.New("LDAP_REFRESH_INTERVAL must be positive")
+	}
+
+	for _, name := range cfg.Sources {
+		if _, ok := avatarSources[name]; !ok {
+			return errors.New("unknown source " + name)
+		}
+	}
+
+	var err error
+
+	if sourceTTLs, err = parseSourceDurations("SOURCE_TTLS", cfg.SourceTTLs); err != nil {
+		return err
+	}
+
+	sourceTimeouts, err = parseSourceDurations("SOURCE_TIMEOUTS", cfg.SourceTimeouts)
+
+	return err
+}
+
+// sourceEnabled reports whether a source of the chain is switched on by its
+// own setting.
+func sourceEnabled(name string) bool {
+	switch name {
+	case sourceGravatar:
+		return cfg.GravatarEnabled
+	case sourceLibravatar:
+		return cfg.Libravatar
+	case sourceDirectory:
+		return len(cfg.PhotoDir) > 0
+	case sourceDatabase:
+		return len(cfg.DBSource) > 0
+	case sourceURL:
+		return len(cfg.LdapURLAttr) > 0
+	case sourceS3:
+		return storage != nil
+	}
+
+	return true
+}
+
+// sourceTTL returns how long avatars from a source are cached unless their
+// upstream says otherwise.
+func sourceTTL(name string) time.Duration {
+	if ttl, ok := sourceTTLs[name]; ok {
+		return ttl
+	}
+
+	return maxTime
+}
+
+func metricsFor(name string) *sourceMetrics {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	m, ok := metrics[name]
+	if !ok {
+		m = &sourceMetrics{}
+		metrics[name] = m
+	}
+
+	return m
+}
+
+// lookupSource asks src for the avatar within its timeout and records the
+// outcome.
+func lookupSource(src avatarSource, req lookupRequest) (avatar, error) {
+	ctx := context.Background()
+	if timeout, ok := sourceTimeouts[src.name()]; ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	m := metricsFor(src.name())
+	start := time.Now()
+	av, err := src.lookup(ctx, req)
+	m.nanos.Add(int64(time.Since(start)))
+
+	switch {
+	case err == nil:
+		m.hits.Add(1)
+		fmt.Fprintln(os.Stderr, req.hash+" → "+src.name())
+	case errors.Is(err, errNotFound):
+		m.misses.Add(1)
+		fmt.Fprintln(os.Stderr, req.hash+" × "+src.name())
+	default:
+		m.errors.Add(1)
+		fmt.Fprintln(os.Stderr, req.hash+" × "+src.name()+": "+err.Error())
+	}
+
+	return av, err
+}
+
+// lookupChain asks the enabled sources of SOURCES in order and returns the
+// first avatar found.
+func lookupChain(req lookupRequest) (avatar, bool) {
+	for _, name := range cfg.Sources {
+		src, ok := avatarSources[name]
+		if !ok || !sourceEnabled(name) {
+			continue
+		}
+
+		if av, err := lookupSource(src, req); err == nil {
+			return av, true
+		}
+	}
+
+	return avatar{}, false
+}
+
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintln(os.Stderr, r)
+		}
+	}()
+
+	writeNoCacheHeaders(w)
+
+	metricsMu.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	metricsMu.Unlock()
+	slices.Sort(names)
+
+	var b strings.Builder
+
+	b.WriteString("# HELP avatarad_source_lookups_total Avatar lookups by source and result.\n")
+	b.WriteString("# TYPE avatarad_source_lookups_total counter\n")
+
+	for _, name := range names {
+		m := metricsFor(name)
+		for _, r := range []struct {
+			result string
+			n      int64
+		}{{"hit", m.hits.Load()}, {"miss", m.misses.Load()}, {"error", m.errors.Load()}} {
+			fmt.Fprintf(&b, "avatarad_source_lookups_total{source=%q,result=%q} %d\n", name, r.result, r.n)
+		}
+	}
+
+	b.WriteString("# HELP avatarad_source_lookup_seconds_total Time spent in avatar lookups by source.\n")
+	b.WriteString("# TYPE avatarad_source_lookup_seconds_total counter\n")
+
+	for _, name := range names {
+		secs := time.Duration(metricsFor(name).nanos.Load()).Seconds()
+		fmt.Fprintf(&b, "avatarad_source_lookup_seconds_total{source=%q} %s\n", name, strconv.FormatFloat(secs, 'f', -1, 64))
+	}
+
+	w.Header().Set(contentType, "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caarlos0/env/v10"
+)
+
+// fakeSource answers lookups with a fixed result and records whether it was
+// asked with a deadline.
+type fakeSource struct {
+	source   string
+	av       avatar
+	err      error
+	calls    int
+	deadline bool
+}
+
+func (f *fakeSource) name() string {
+	return f.source
+}
+
+func (f *fakeSource) lookup(ctx context.Context, _ lookupRequest) (avatar, error) {
+	f.calls++
+	_, f.deadline = ctx.Deadline()
+
+	return f.av, f.err
+}
+
+func withSources(t *testing.T, sources ...*fakeSource) {
+	t.Helper()
+
+	old := avatarSources
+	avatarSources = map[string]avatarSource{}
+	for _, src := range sources {
+		avatarSources[src.source] = src
+	}
+	t.Cleanup(func() { avatarSources = old })
+}
+
+func TestSourcesConfig(t *testing.T) {
+	for _, kv := range [][2]string{
+		{"SOURCES", "ldap,nowhere"},
+		{"SOURCE_TTLS", "nowhere=600"},
+		{"SOURCE_TTLS", "ldap"},
+		{"SOURCE_TIMEOUTS", "ldap=0"},
+	} {
+		t.Run(kv[0]+"="+kv[1], func(t *testing.T) {
+			parseTestConfig(t)
+
+			t.Setenv(kv[0], kv[1])
+			if err := env.Parse(&cfg); err != nil {
+				t.Fatalf("%v while reading configuration", err)
+			}
+
+			if err := checkConfig(); err == nil {
+				t.Errorf("%s=%s: want error", kv[0], kv[1])
+			}
+		})
+	}
+}
+
+func TestLookupChain(t *testing.T) {
+	t.Setenv("SOURCES", "ldap,libravatar,gravatar")
+	t.Setenv("SOURCE_TIMEOUTS", "gravatar=2")
+	parseTestConfig(t)
+
+	photo := avatar{Image: []byte{1}, Source: sourceGravatar}
+	ldap := &fakeSource{source: sourceLDAP, err: errors.New("unreachable")}
+	libravatar := &fakeSource{source: sourceLibravatar, av: photo}
+	gravatar := &fakeSource{source: sourceGravatar, av: photo}
+	withSources(t, ldap, libravatar, gravatar)
+
+	metrics = map[string]*sourceMetrics{}
+
+	// Libravatar and Gravatar are switched off by default
+	if _, ok := lookupChain(lookupRequest{hash: "a"}); ok {
+		t.Error("Want no avatar from disabled sources")
+	}
+
+	cfg.GravatarEnabled = true
+
+	av, ok := lookupChain(lookupRequest{hash: "a"})
+	if !ok || av.Source != sourceGravatar {
+		t.Fatalf("Want avatar from the next source after an error, got '%s'", av.Source)
+	}
+
+	if ldap.calls != 2 || libravatar.calls != 0 || gravatar.calls != 1 {
+		t.Errorf("Want calls 2, 0, 1, got %d, %d, %d", ldap.calls, libravatar.calls, gravatar.calls)
+	}
+
+	if ldap.deadline || !gravatar.deadline {
+		t.Error("Want a deadline for sources with a timeout only")
+	}
+
+	// the chain stops at the first hit
+	cfg.Sources = []string{sourceGravatar, sourceLDAP}
+	if _, ok := lookupChain(lookupRequest{hash: "a"}); !ok || ldap.calls != 2 {
+		t.Error("Want the chain stopped at the first hit")
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, want := range []string{
+		`avatarad_source_lookups_total{source="ldap",result="error"} 2`,
+		`avatarad_source_lookups_total{source="gravatar",result="hit"} 2`,
+		`avatarad_source_lookups_total{source="gravatar",result="miss"} 0`,
+		`avatarad_source_lookup_seconds_total{source="ldap"} `,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Want '%s' in metrics, got\n%s", want, w.Body.String())
+		}
+	}
+
+	if strings.Contains(w.Body.String(), `source="libravatar"`) {
+		t.Error("Want no metrics for sources never asked")
+	}
+}
+
+func TestSourceTTL(t *testing.T) {
+	t.Setenv("SOURCE_TTLS", "gravatar=3600")
+	parseTestConfig(t)
+
+	old := time.Now().Add(-time.Hour + time.Minute)
+
+	tests := []struct {
+		av      avatar
+		expired bool
+	}{
+		{avatar{Source: sourceGravatar, LastUpdate: old}, false},
+		{avatar{Source: sourceLDAP, LastUpdate: old}, true},
+		{avatar{Source: sourceGravatar, LastUpdate: old, MaxAge: time.Minute}, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.av.expired(); got != tt.expired {
+			t.Errorf("%s max-age %v: want expired %t, got %t", tt.av.Source, tt.av.MaxAge, tt.expired, got)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minUpstreamTTL  = time.Minute
+	userAgentHeader = "User-Agent"
+)
+
+var (
+	errBreakerOpen = errors.New("circuit breaker open")
+	errNotFound    = errors.New("not found")
+
+	// gravatar is the client for the Gravatar service, set up on first use
+	gravatar   *upstream
+	gravatarMu sync.Mutex
+)
+
+// breaker stops calls to an upstream after failures consecutive failures
+// for cooldown. Once the cooldown is over a single trial call is let
+// through: success closes the breaker, failure opens it again.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	b.trial = true
+
+	return true
+}
+
+func (b *breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if !failed {
+		b.failures = 0
+
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// upstream is an HTTP client for a remote avatar service with timeouts,
+// proxy and CA settings, a User-Agent and a circuit breaker.
+type upstream struct {
+	name      string
+	client    *http.Client
+	userAgent string
+	breaker   *breaker
+	// sign authenticates requests, if the upstream needs it
+	sign func(req *http.Request, payloadHash string)
+}
+
+func checkUpstreamConfig() error {
+	if cfg.DialTimeout < 1 || cfg.UpstreamTimeout < 1 {
+		return errors.New("UPSTREAM_DIAL_TIMEOUT and UPSTREAM_TIMEOUT must be positive")
+	}
+
+	if cfg.BreakerFailures < 1 || cfg.BreakerCooldown < 1 {
+		return errors.New("BREAKER_FAILURES and BREAKER_COOLDOWN must be positive")
+	}
+
+	return nil
+}
+
+// newUpstream sets up a client with the UPSTREAM_* settings. Proxies are
+// taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables.
+func newUpstream(name string) (*upstream, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	if len(cfg.UpstreamCAFile) != 0 {
+		caCert, err := os.ReadFile(cfg.UpstreamCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if !rootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no certificates found in " + cfg.UpstreamCAFile)
+		}
+	}
+
+	dialTimeout := time.Duration(cfg.DialTimeout) * time.Second
+	timeout := time.Duration(cfg.UpstreamTimeout) * time.Second
+
+	userAgent := cfg.UserAgent
+	if len(userAgent) == 0 {
+		userAgent = "avatarad/" + pkgVersion
+	}
+
+	return &upstream{
+		name: name,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: dialTimeout}).DialContext,
+				TLSClientConfig:       &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12},
+				TLSHandshakeTimeout:   dialTimeout,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConnsPerHost:   4,
+				IdleConnTimeout:       time.Minute,
+			},
+		},
+		userAgent: userAgent,
+		breaker: &breaker{
+			threshold: cfg.BreakerFailures,
+			cooldown:  time.Duration(cfg.BreakerCooldown) * time.Second,
+		},
+	}, nil
+}
+
+// fetched is an upstream response along with its cache validators and
+// freshness lifetime, maxAge is zero if the upstream did not state one.
+type fetched struct {
+	body         []byte
+	header       http.Header
+	etag         string
+	lastModified string
+	maxAge       time.Duration
+	notModified  bool
+}
+
+// cacheMaxAge returns how long a response may be cached according to its
+// Cache-Control or Expires headers, within minUpstreamTTL and
+// UPSTREAM_MAX_TTL, or zero if the headers do not say.
+func cacheMaxAge(h http.Header) time.Duration {
+	var (
+		age    time.Duration
+		stated bool
+	)
+
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(k) {
+		case "no-cache", "no-store":
+			return minUpstreamTTL
+		case "max-age":
+			// max-age=0 asks for revalidation, it is not missing
+			if n, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil {
+				age, stated = time.Duration(n)*time.Second, true
+			}
+		}
+	}
+
+	if !stated {
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			return 0
+		}
+
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+
+		age = expires.Sub(date)
+	}
+
+	return min(max(age, minUpstreamTTL), time.Duration(cfg.UpstreamMaxTTL)*time.Second)
+}
+
+// fetch gets an image from url, conditionally if etag or lastModified of a
+// cached copy are given. A 404 is a regular miss reported as errNotFound;
+// network errors, timeouts and other statuses count as failures of the
+// upstream. Bodies are read up to MAX_IMAGE_BYTES plus one byte, which is
+// enough for the limits check to reject them.
+func (u *upstream) fetch(ctx context.Context, url, etag, lastModified string) (fetched, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fetched{}, err
+	}
+	req.Header.Set(userAgentHeader, u.userAgent)
+
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	if len(lastModified) > 0 {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	if u.sign != nil {
+		u.sign(req, emptyPayloadHash)
+	}
+
+	// the trial slot of a half-open breaker is only taken once nothing but
+	// the call itself, which records its outcome, can fail
+	if !u.breaker.allow() {
+		return fetched{}, errBreakerOpen
+	}
+
+	res, err := u.client.Do(req)
+	if err != nil {
+		u.breaker.record(true)
+
+		return fetched{}, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, cfg.MaxImageBytes+1))
+	if cerr := res.Body.Close(); err == nil {
+		err = cerr
+	}
+
+	switch {
+	case err != nil:
+	case res.StatusCode == http.StatusNotFound:
+		u.breaker.record(false)
+
+		return fetched{}, errNotFound
+	case res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotModified:
+		err = fmt.Errorf("%s responded %s", u.name, res.Status)
+	}
+
+	u.breaker.record(err != nil)
+	if err != nil {
+		return fetched{}, err
+	}
+
+	return fetched{
+		body:         body,
+		header:       res.Header,
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+		maxAge:       cacheMaxAge(res.Header),
+		notModified:  res.StatusCode == http.StatusNotModified,
+	}, nil
+}
+
+// fetchGravatar gets the avatar of h from Gravatar, asking for a 404 rather
+// than the Gravatar default picture if there is none.
+func fetchGravatar(ctx context.Context, h, etag, lastModified string) (fetched, error) {
+	u, err := gravatarUpstream()
+	if err != nil {
+		return fetched{}, err
+	}
+
+	return u.fetch(ctx, cfg.GravatarURL+"/"+h+"?s=490&d="+strconv.Itoa(http.StatusNotFound), etag, lastModified)
+}
+
+func gravatarUpstream() (*upstream, error) {
+	gravatarMu.Lock()
+	defer gravatarMu.Unlock()
+
+	if gravatar != nil {
+		return gravatar, nil
+	}
+
+	u, err := newUpstream("Gravatar")
+	if err != nil {
+		return nil, err
+	}
+	gravatar = u
+
+	return u, nil
+}
+
+// refreshUpstream looks req.hash up with fetch and returns the result as
+// coming from source. A cached entry of the same source is revalidated: if
+// it is not modified it is kept with a renewed lifetime.
+func refreshUpstream(
+	req lookupRequest, source string, fetch func(etag, lastModified string) (fetched, error),
+) (avatar, error) {
+	var (
+		res fetched
+		err error
+	)
+
+	if req.cached.Source == source {
+		res, err = fetch(req.cached.ETag, req.cached.LastModified)
+	} else {
+		res, err = fetch("", "")
+	}
+
+	if err != nil {
+		return avatar{}, err
+	}
+
+	av := req.cached
+	if !res.notModified {
+		av = ingestAvatar(res.body, source, req.hash)
+	}
+
+	av.LastUpdate = time.Now()
+	if !av.negative() {
+		av.MaxAge = res.maxAge
+		if len(res.etag) > 0 || len(res.lastModified) > 0 {
+			av.ETag, av.LastModified = res.etag, res.lastModified
+		}
+	}
+
+	return av, nil
+}
+
+type gravatarSource struct{}
+
+func (gravatarSource) name() string {
+	return sourceGravatar
+}
+
+func (gravatarSource) lookup(ctx context.Context, req lookupRequest) (avatar, error) {
+	return refreshUpstream(req, sourceGravatar, func(etag, lastModified string) (fetched, error) {
+		return fetchGravatar(ctx, req.hash, etag, lastModified)
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestUpstream(t *testing.T) *upstream {
+	t.Helper()
+
+	u, err := newUpstream("test")
+	if err != nil {
+		t.Fatalf("%v while setting up upstream", err)
+	}
+
+	return u
+}
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{threshold: 2, cooldown: 50 * time.Millisecond}
+
+	for range 2 {
+		if !b.allow() {
+			t.Fatal("Want closed breaker to allow calls")
+		}
+		b.record(true)
+	}
+
+	if b.allow() {
+		t.Error("Want breaker open after repeated failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !b.allow() {
+		t.Error("Want a trial call after the cooldown")
+	}
+
+	if b.allow() {
+		t.Error("Want a single trial call at a time")
+	}
+
+	b.record(true)
+	if b.allow() {
+		t.Error("Want breaker open again after a failed trial")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	b.allow()
+	b.record(false)
+	if !b.allow() || !b.allow() {
+		t.Error("Want breaker closed after a successful trial")
+	}
+}
+
+func TestFetchGravatar(t *testing.T) {
+	const m string = "eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"
+
+	t.Setenv("UPSTREAM_USER_AGENT", "avatarad-test")
+	t.Setenv("MAX_IMAGE_BYTES", "8")
+	parseTestConfig(t)
+
+	var query, agent string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, agent = r.URL.RequestURI(), r.UserAgent()
+
+		switch r.URL.Path {
+		case "/avatar/" + m:
+			_, _ = w.Write([]byte("0123456789"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cfg.GravatarURL = srv.URL + "/avatar"
+	gravatar = newTestUpstream(t)
+
+	res, err := fetchGravatar(context.Background(), m, "", "")
+	if err != nil {
+		t.Fatalf("%v while fetching", err)
+	}
+
+	if got, want := query, "/avatar/"+m+"?s=490&d=404"; got != want {
+		t.Errorf("Want request '%s', got '%s'", want, got)
+	}
+
+	if agent != "avatarad-test" {
+		t.Errorf("Want User-Agent 'avatarad-test', got '%s'", agent)
+	}
+
+	// one byte over the limit, so the limits check rejects it
+	if got := string(res.body); got != "012345678" {
+		t.Errorf("Want body cut after 9 bytes, got '%s'", got)
+	}
+
+	_, err = fetchGravatar(context.Background(), "ffffffffffffffffffffffffffffffff", "", "")
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("Want not found error, got %v", err)
+	}
+}
+
+func TestFetchFailures(t *testing.T) {
+	t.Setenv("BREAKER_FAILURES", "3")
+	t.Setenv("UPSTREAM_TIMEOUT", "1")
+	parseTestConfig(t)
+
+	var hits atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+
+		if r.URL.Path == "/slow" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+
+		http.Error(w, "broken", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	u := newTestUpstream(t)
+
+	start := time.Now()
+	if _, err := u.fetch(context.Background(), srv.URL+"/slow", "", ""); err == nil {
+		t.Error("Want timeout error")
+	}
+
+	if d := time.Since(start); d > 1400*time.Millisecond {
+		t.Errorf("Want request given up after the timeout, took %v", d)
+	}
+
+	for range 5 {
+		if _, err := u.fetch(context.Background(), srv.URL, "", ""); err == nil {
+			t.Error("Want error for bad gateway")
+		}
+	}
+
+	// the timeout and two errors opened the breaker
+	if got := hits.Load(); got != 3 {
+		t.Errorf("Want 3 calls before the breaker opens, got %d", got)
+	}
+
+	if _, err := u.fetch(context.Background(), srv.URL, "", ""); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("Want open breaker error, got %v", err)
+	}
+}
+
+func TestFetchBadURL(t *testing.T) {
+	t.Setenv("BREAKER_FAILURES", "1")
+	parseTestConfig(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	u := newTestUpstream(t)
+	u.breaker.cooldown = 10 * time.Millisecond
+
+	u.breaker.record(true)
+	time.Sleep(20 * time.Millisecond)
+
+	// failing before the call must not hold on to the trial slot
+	if _, err := u.fetch(context.Background(), "http://[::1", "", ""); err == nil || errors.Is(err, errBreakerOpen) {
+		t.Fatalf("Want error for malformed URL, got %v", err)
+	}
+
+	if res, err := u.fetch(context.Background(), srv.URL, "", ""); err != nil || string(res.body) != "ok" {
+		t.Errorf("Want the trial call let through, got '%s' (%v)", res.body, err)
+	}
+}
+
+func TestFetchCustomCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	parseTestConfig(t)
+
+	if _, err := newTestUpstream(t).fetch(context.Background(), srv.URL, "", ""); err == nil {
+		t.Error("Want error for unknown CA")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("UPSTREAM_CA_FILE", caFile)
+	parseTestConfig(t)
+
+	res, err := newTestUpstream(t).fetch(context.Background(), srv.URL, "", "")
+	if err != nil || string(res.body) != "ok" {
+		t.Errorf("Want response with custom CA, got '%s' (%v)", res.body, err)
+	}
+
+	cfg.UpstreamCAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := newUpstream("test"); err == nil {
+		t.Error("Want error for missing CA file")
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	t.Setenv("UPSTREAM_MAX_TTL", "3600")
+	parseTestConfig(t)
+
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header http.Header
+		want   time.Duration
+	}{
+		{http.Header{}, 0},
+		{http.Header{"Cache-Control": {"public, max-age=300"}}, 5 * time.Minute},
+		{http.Header{"Cache-Control": {"max-age=5"}}, minUpstreamTTL},
+		{http.Header{"Cache-Control": {"max-age=0"}}, minUpstreamTTL},
+		{http.Header{"Cache-Control": {"max-age=-5"}}, minUpstreamTTL},
+		{http.Header{
+			"Cache-Control": {"max-age=0"},
+			"Date":          {date.Format(http.TimeFormat)},
+			"Expires":       {date.Add(10 * time.Minute).Format(http.TimeFormat)},
+		}, minUpstreamTTL},
+		{http.Header{"Cache-Control": {"max-age=86400"}}, time.Hour},
+		{http.Header{"Cache-Control": {"no-cache"}}, minUpstreamTTL},
+		{http.Header{
+			"Date":    {date.Format(http.TimeFormat)},
+			"Expires": {date.Add(10 * time.Minute).Format(http.TimeFormat)},
+		}, 10 * time.Minute},
+		{http.Header{"Expires": {"0"}}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := cacheMaxAge(tt.header); got != tt.want {
+			t.Errorf("%v: want %v, got %v", tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestGravatarSource(t *testing.T) {
+	const m string = "abababababababababababababababab"
+
+	parseTestConfig(t)
+
+	photo := testJpeg(t, 64, 64)
+
+	var requests, conditional atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=600")
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		_, _ = w.Write(photo)
+	}))
+	defer srv.Close()
+
+	cfg.GravatarURL = srv.URL
+	gravatar = newTestUpstream(t)
+	hs = map[string]avatar{}
+
+	src := gravatarSource{}
+
+	av, err := src.lookup(context.Background(), lookupRequest{hash: m})
+	if err != nil {
+		t.Fatalf("%v while looking up Gravatar", err)
+	}
+
+	if av.Source != sourceGravatar || av.ETag != `"v1"` || av.MaxAge != 10*time.Minute {
+		t.Errorf("Want Gravatar entry with validators, got source %s, ETag %s, max-age %v", av.Source, av.ETag, av.MaxAge)
+	}
+
+	if av.LastUpdate = time.Now().Add(-11 * time.Minute); !av.expired() {
+		t.Error("Want entry expired after the upstream max-age")
+	}
+
+	again, err := src.lookup(context.Background(), lookupRequest{hash: m, cached: av})
+	if err != nil || conditional.Load() != 1 {
+		t.Fatalf("Want a conditional request, got %d of %d", conditional.Load(), requests.Load())
+	}
+
+	if again.Checksum != av.Checksum || again.expired() {
+		t.Error("Want the cached image kept with a renewed lifetime")
+	}
+
+	if again.ETag != `"v1"` {
+		t.Errorf("Want the validators kept, got ETag %s", again.ETag)
+	}
+}
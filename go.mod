@@ -5,9 +5,12 @@ go 1.23.0
 toolchain go1.24.2
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/caarlos0/env/v10 v10.0.0
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/go-ldap/ldap/v3 v3.4.10
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.33
 )
 
 require (
@@ -15,4 +18,5 @@ require (
 	github.com/go-asn1-ber/asn1-ber v1.5.7 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/sys v0.32.0 // indirect
 )